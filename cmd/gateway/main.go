@@ -1,37 +1,211 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 
+	"shardo/internal/auth"
+	"shardo/internal/config"
 	"shardo/internal/gateway"
+	"shardo/internal/logging"
+	"shardo/internal/ratelimit"
+	"shardo/internal/tlsutil"
+	"shardo/internal/tracing"
+	"shardo/pkg/hashring"
 )
 
 func main() {
-	port := os.Getenv("GATEWAY_HTTP_PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.LoadGateway(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	nodesEnv := os.Getenv("NODES")
-	nodes := make(map[string]string)
-	for _, pair := range strings.Split(nodesEnv, ",") {
-		parts := strings.Split(pair, ":")
-		if len(parts) == 3 {
-			nodes[parts[0]] = parts[1] + ":" + parts[2]
+	if err := logging.Setup("shardo-gateway", cfg.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	hashFunc, _ := hashring.HashFuncByName(cfg.HashFunc)
+	gcfg, err := gatewayConfig(cfg)
+	if err != nil {
+		fatal("setting up auth", "err", err)
+	}
+	gcfg.Zone = cfg.Zone
+	gcfg.Replicas = cfg.VirtualReplicas
+	gcfg.LoadEpsilon = cfg.LoadEpsilon
+	gcfg.HashFunc = hashFunc
+	gcfg.ShutdownTimeout = cfg.ShutdownTimeout.Duration
+	gcfg.NodeSecret = cfg.NodeSecret
+	gcfg.RateLimit, gcfg.Shedder = newLimits(cfg.RateLimit)
+	if cfg.RingFile != "" {
+		data, err := os.ReadFile(cfg.RingFile)
+		if err != nil {
+			fatal("reading ring file", "path", cfg.RingFile, "err", err)
+		}
+		ring, err := hashring.Load(data, hashring.WithLoadBound(cfg.LoadEpsilon))
+		if err != nil {
+			fatal("loading ring file", "path", cfg.RingFile, "err", err)
+		}
+		for _, n := range ring.Nodes() {
+			if _, ok := gcfg.Nodes[n]; !ok {
+				fatal("ring node has no address in the node list", "node", n)
+			}
+		}
+		slog.Info("loaded ring", "epoch", ring.Epoch(), "path", cfg.RingFile)
+		gcfg.Ring = ring
+	}
+	if cfg.TLS.Enabled() {
+		if gcfg.TLS, err = tlsutil.NewReloader(cfg.TLS.Files()); err != nil {
+			fatal("loading HTTPS certificates", "err", err)
+		}
+	}
+	if cfg.NodeTLS.Enabled() {
+		if gcfg.NodeTLS, err = tlsutil.NewReloader(cfg.NodeTLS.Files()); err != nil {
+			fatal("loading node TLS certificates", "err", err)
 		}
+		gcfg.NodeServerName = cfg.NodeTLS.ServerName
+	}
+	shutdown, err := tracing.Setup(context.Background(), "shardo-gateway", cfg.TracesExporter)
+	if err != nil {
+		fatal("setting up tracing", "err", err)
+	}
+	defer shutdown(context.Background())
+
+	g := gateway.NewGateway(gcfg)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go reloadOnHangup(ctx, g, cfg, gcfg.RateLimit, gcfg.Shedder)
+
+	slog.Info("starting gateway", "port", cfg.Port, "nodes", len(cfg.Nodes), "replication_factor", cfg.ReplicationFactor,
+		"auth", cfg.Auth.Enabled())
+	if err := g.Serve(ctx, cfg.Port); err != nil {
+		fatal("gateway failed", "err", err)
+	}
+	slog.Info("gateway stopped")
+}
+
+// gatewayConfig maps the reloadable part of cfg.
+func gatewayConfig(cfg *config.Gateway) (gateway.GatewayConfig, error) {
+	gcfg := gateway.GatewayConfig{
+		Nodes:             make(map[string]string, len(cfg.Nodes)),
+		NodeLabels:        make(map[string]hashring.Labels, len(cfg.Nodes)),
+		NodeWeights:       make(map[string]int, len(cfg.Nodes)),
+		ReplicationFactor: cfg.ReplicationFactor,
+		RequestTimeout:    cfg.RequestTimeout.Duration,
+		TrustProxy:        cfg.RateLimit.TrustProxy,
 	}
-	replicationFactor := 2
-	if v := os.Getenv("SHARDO_REPLICATION_FACTOR"); v != "" {
-		if val, err := strconv.Atoi(v); err == nil && val > 0 {
-			replicationFactor = val
+	for _, n := range cfg.Nodes {
+		gcfg.Nodes[n.Name] = n.Addr
+		gcfg.NodeLabels[n.Name] = hashring.Labels{Zone: n.Zone, Rack: n.Rack, Host: n.Host}
+		gcfg.NodeWeights[n.Name] = n.Weight
+	}
+	if cfg.Auth.Enabled() {
+		guard, err := newGuard(cfg.Auth)
+		if err != nil {
+			return gcfg, err
 		}
+		gcfg.Auth = guard
 	}
-	cfg := gateway.GatewayConfig{
-		Nodes:    nodes,
-		Replicas: replicationFactor,
+	return gcfg, nil
+}
+
+func newGuard(cfg config.Auth) (*auth.Guard, error) {
+	policy := make(auth.Policy, len(cfg.Policy))
+	for i, rule := range cfg.Policy {
+		policy[i] = auth.Rule{Principal: rule.Principal, Namespaces: rule.Namespaces, Prefixes: rule.Prefixes}
+		for _, op := range rule.Operations {
+			policy[i].Operations = append(policy[i].Operations, auth.Operation(op))
+		}
 	}
-	log.Printf("Starting gateway on port %s with replication factor %d", port, replicationFactor)
-	gateway.NewGateway(cfg).Serve(port)
+	var authenticators []auth.Authenticator
+	if len(cfg.APIKeys) > 0 {
+		keys := make(map[string]string, len(cfg.APIKeys))
+		for _, k := range cfg.APIKeys {
+			keys[k.Key] = k.Principal
+		}
+		authenticators = append(authenticators, auth.NewAPIKeys(keys))
+	}
+	if cfg.HMACSecret != "" || cfg.JWKSFile != "" {
+		opts := auth.TokenOptions{HMACSecret: []byte(cfg.HMACSecret), Issuer: cfg.Issuer, Audience: cfg.Audience}
+		if cfg.JWKSFile != "" {
+			keys, err := auth.LoadJWKS(cfg.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.Keys = keys
+		}
+		authenticators = append(authenticators, auth.NewTokens(opts))
+	}
+	return auth.NewGuard(policy, authenticators...), nil
+}
+
+// newLimits builds the rate limiter and load shedder cfg asks for.
+func newLimits(cfg config.RateLimit) (*ratelimit.Limiter, *ratelimit.Shedder) {
+	var limiter *ratelimit.Limiter
+	var shedder *ratelimit.Shedder
+	if cfg.RequestsPerSecond > 0 {
+		limiter = ratelimit.NewLimiter(cfg.RequestsPerSecond, cfg.Burst)
+	}
+	if cfg.MaxConcurrency > 0 {
+		shedder = ratelimit.NewShedder(cfg.MinConcurrency, cfg.MaxConcurrency, cfg.TargetLatency.Duration)
+	}
+	return limiter, shedder
+}
+
+// reloadOnHangup re-reads the config on SIGHUP and applies the node list
+// (only addresses with ring_file), replication factor, request timeout, auth (including the JWKS file), rate
+// limits and log level. Limits are only rebuilt when they change, so
+// buckets and the adapted concurrency limit survive other reloads.
+// Everything else needs a restart; certificate files are reloaded on their
+// own when they change.
+func reloadOnHangup(ctx context.Context, g *gateway.Gateway, startup *config.Gateway,
+	limiter *ratelimit.Limiter, shedder *ratelimit.Shedder) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	limits := startup.RateLimit
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := config.LoadGateway(os.Args[1:])
+		if err != nil {
+			slog.Error("config reload failed, keeping current settings", "err", err)
+			continue
+		}
+		if cfg.Port != startup.Port || cfg.HashFunc != startup.HashFunc ||
+			cfg.VirtualReplicas != startup.VirtualReplicas || cfg.RingFile != startup.RingFile ||
+			cfg.TLS != startup.TLS || cfg.NodeTLS != startup.NodeTLS || cfg.NodeSecret != startup.NodeSecret {
+			slog.Warn("port, hash_func, virtual_replicas, ring_file, tls and node_secret changes need a restart")
+		}
+		gcfg, err := gatewayConfig(cfg)
+		if err != nil {
+			slog.Error("config reload failed, keeping current settings", "err", err)
+			continue
+		}
+		gcfg.RateLimit, gcfg.Shedder = limiter, shedder
+		if cfg.RateLimit != limits {
+			gcfg.RateLimit, gcfg.Shedder = newLimits(cfg.RateLimit)
+		}
+		if err := g.Reload(gcfg); err != nil {
+			slog.Warn("config reload rejected, keeping current settings", "err", err)
+			continue
+		}
+		limiter, shedder, limits = gcfg.RateLimit, gcfg.Shedder, cfg.RateLimit
+		if err := logging.SetLevel(cfg.LogLevel); err != nil {
+			slog.Error("invalid log level, keeping the current one", "err", err)
+		}
+		slog.Info("config reloaded", "nodes", len(cfg.Nodes), "replication_factor", cfg.ReplicationFactor,
+			"request_timeout", cfg.RequestTimeout.String(), "log_level", cfg.LogLevel, "auth", cfg.Auth.Enabled())
+	}
+}
+
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
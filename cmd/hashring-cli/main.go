@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -10,45 +11,82 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		runSimulate(os.Args[2:])
+		return
+	}
 	nodesStr := flag.String("nodes", "", "Comma-separated list of node names")
 	keys := flag.Int("keys", 1000, "Number of keys to distribute")
 	addNode := flag.String("add", "", "Add a node and show redistribution")
 	removeNode := flag.String("remove", "", "Remove a node and show redistribution")
 	virtualReplicas := flag.Int("replicas", 100, "Number of virtual replicas per node")
+	hashName := flag.String("hash", "sha256", "Ring hash function: sha256, xxhash, murmur3 or fnv1a")
+	ringFile := flag.String("ring", "", "Load the ring from a JSON or binary snapshot instead of --nodes")
+	exportFile := flag.String("export", "", "Write the resulting ring as a JSON snapshot")
+	showRanges := flag.Bool("ranges", false, "Print the hash ranges that move after --add/--remove")
+	format := flag.String("format", "table", "Output format: table, json or csv")
 	flag.Parse()
 
-	if *nodesStr == "" {
-		fmt.Println("Usage: hashring-cli --nodes node1,node2 --keys 1000 [--add node3] [--remove node2] [--replicas 100]")
+	if *nodesStr == "" && *ringFile == "" {
+		fmt.Println("Usage: hashring-cli --nodes node1,node2 | --ring ring.json [--keys 1000] [--add node3] [--remove node2] [--replicas 100] [--hash sha256] [--ranges] [--export ring.json] [--format table|json|csv]")
 		os.Exit(1)
 	}
-	nodes := strings.Split(*nodesStr, ",")
-	ring := hashring.New(*virtualReplicas)
-	for _, n := range nodes {
-		ring.AddNode(n)
+	var ring *hashring.HashRing
+	if *ringFile != "" {
+		data, err := os.ReadFile(*ringFile)
+		if err != nil {
+			fail("Error reading ring: %v", err)
+		}
+		if ring, err = hashring.Load(data); err != nil {
+			fail("Error loading ring: %v", err)
+		}
+	} else {
+		hashFunc, ok := hashring.HashFuncByName(*hashName)
+		if !ok {
+			fail("Unknown hash function: %s", *hashName)
+		}
+		ring = hashring.New(*virtualReplicas, hashring.WithHashFunc(hashFunc))
+		for _, n := range strings.Split(*nodesStr, ",") {
+			ring.AddNode(n)
+		}
+	}
+	before, err := hashring.FromSnapshot(ring.Snapshot())
+	if err != nil {
+		fail("Error copying ring: %v", err)
 	}
 
 	if *addNode != "" {
 		ring.AddNode(*addNode)
-		nodes = append(nodes, *addNode)
-		fmt.Printf("Added node: %s\n", *addNode)
 	}
 	if *removeNode != "" {
 		ring.RemoveNode(*removeNode)
-		fmt.Printf("Removed node: %s\n", *removeNode)
 	}
 
-	distribution := make(map[string]int)
-	for _, n := range ring.Nodes() {
-		distribution[n] = 0
+	sample := make([]string, *keys)
+	for i := range sample {
+		sample[i] = fmt.Sprintf("key%d", i)
+	}
+	r := buildReport(before, ring, sample)
+	r.Added, r.Removed = *addNode, *removeNode
+	if *showRanges {
+		changes, err := hashring.Diff(before, ring)
+		if err != nil {
+			fail("Error diffing rings: %v", err)
+		}
+		r.Ranges = append([]hashring.RangeChange{}, changes...)
 	}
-	for i := 0; i < *keys; i++ {
-		key := fmt.Sprintf("key%d", i)
-		node := ring.GetNode(key)
-		distribution[node]++
+	if err := writeReport(os.Stdout, r, *format); err != nil {
+		fail("Error writing report: %v", err)
 	}
 
-	fmt.Println("Key distribution:")
-	for _, n := range ring.Nodes() {
-		fmt.Printf("%s: %d\n", n, distribution[n])
+	if *exportFile != "" {
+		data, err := json.MarshalIndent(ring, "", "  ")
+		if err != nil {
+			fail("Error encoding ring: %v", err)
+		}
+		if err := os.WriteFile(*exportFile, data, 0o600); err != nil {
+			fail("Error writing ring: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported ring epoch %d to %s\n", ring.Epoch(), *exportFile)
 	}
 }
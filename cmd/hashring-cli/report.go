@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"shardo/pkg/hashring"
+)
+
+type nodeStats struct {
+	Node         string  `json:"node"`
+	Weight       int     `json:"weight"`
+	Keys         int     `json:"keys"`
+	Ideal        float64 `json:"ideal"`
+	DeviationPct float64 `json:"deviation_pct"`
+}
+
+type report struct {
+	Keys         int                    `json:"keys"`
+	Added        string                 `json:"added,omitempty"`
+	Removed      string                 `json:"removed,omitempty"`
+	Nodes        []nodeStats            `json:"nodes"`
+	Mean         float64                `json:"mean"`
+	StdDev       float64                `json:"stddev"`
+	MinMaxRatio  float64                `json:"min_max_ratio"`
+	MovedKeys    int                    `json:"moved_keys"`
+	MovedPct     float64                `json:"moved_pct"`
+	IdealMovePct float64                `json:"ideal_moved_pct"`
+	Ranges       []hashring.RangeChange `json:"moved_ranges,omitempty"`
+}
+
+// buildReport places every key on both rings and summarises the resulting
+// distribution on after, plus how many keys changed owner since before.
+func buildReport(before, after *hashring.HashRing, keys []string) report {
+	r := report{Keys: len(keys)}
+	counts := make(map[string]int)
+	for _, k := range keys {
+		node := after.GetNode(k)
+		counts[node]++
+		if before.GetNode(k) != node {
+			r.MovedKeys++
+		}
+	}
+	nodes := after.Nodes()
+	sort.Strings(nodes)
+	totalWeight := 0
+	for _, n := range nodes {
+		totalWeight += after.Weight(n)
+	}
+	minKeys, maxKeys := math.MaxInt, 0
+	for _, n := range nodes {
+		ideal := float64(len(keys)) * float64(after.Weight(n)) / float64(totalWeight)
+		s := nodeStats{Node: n, Weight: after.Weight(n), Keys: counts[n], Ideal: ideal}
+		if ideal > 0 {
+			s.DeviationPct = (float64(s.Keys) - ideal) / ideal * 100
+		}
+		r.Nodes = append(r.Nodes, s)
+		r.Mean += float64(s.Keys)
+		minKeys = min(minKeys, s.Keys)
+		maxKeys = max(maxKeys, s.Keys)
+	}
+	if len(nodes) == 0 {
+		return r
+	}
+	r.Mean /= float64(len(nodes))
+	for _, s := range r.Nodes {
+		r.StdDev += (float64(s.Keys) - r.Mean) * (float64(s.Keys) - r.Mean)
+	}
+	r.StdDev = math.Sqrt(r.StdDev / float64(len(nodes)))
+	if maxKeys > 0 {
+		r.MinMaxRatio = float64(minKeys) / float64(maxKeys)
+	}
+	if len(keys) > 0 {
+		r.MovedPct = float64(r.MovedKeys) / float64(len(keys)) * 100
+	}
+	r.IdealMovePct = idealMovePct(before, after)
+	return r
+}
+
+// idealMovePct is the share of keys a perfect ring would move: the total
+// share of the key space gained by nodes whose weighted share grew.
+func idealMovePct(before, after *hashring.HashRing) float64 {
+	shares := func(h *hashring.HashRing) map[string]float64 {
+		m := make(map[string]float64)
+		total := 0
+		for _, n := range h.Nodes() {
+			total += h.Weight(n)
+		}
+		for _, n := range h.Nodes() {
+			m[n] = float64(h.Weight(n)) / float64(total)
+		}
+		return m
+	}
+	oldShares := shares(before)
+	gained := 0.0
+	for n, share := range shares(after) {
+		if share > oldShares[n] {
+			gained += share - oldShares[n]
+		}
+	}
+	return gained * 100
+}
+
+func writeReport(w io.Writer, r report, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	case "csv":
+		return writeCSV(w, r)
+	case "table":
+		return writeTable(w, r)
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func writeCSV(w io.Writer, r report) error {
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"node", "weight", "keys", "ideal", "deviation_pct"})
+	for _, s := range r.Nodes {
+		_ = cw.Write([]string{s.Node, strconv.Itoa(s.Weight), strconv.Itoa(s.Keys), formatFloat(s.Ideal), formatFloat(s.DeviationPct)})
+	}
+	cw.Flush()
+	if _, err := fmt.Fprintln(w); err != nil {
+		return err
+	}
+	_ = cw.Write([]string{"stat", "value"})
+	for _, row := range [][2]string{
+		{"keys", strconv.Itoa(r.Keys)},
+		{"mean", formatFloat(r.Mean)},
+		{"stddev", formatFloat(r.StdDev)},
+		{"min_max_ratio", formatFloat(r.MinMaxRatio)},
+		{"moved_keys", strconv.Itoa(r.MovedKeys)},
+		{"moved_pct", formatFloat(r.MovedPct)},
+		{"ideal_moved_pct", formatFloat(r.IdealMovePct)},
+	} {
+		_ = cw.Write(row[:])
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeTable(w io.Writer, r report) error {
+	if r.Added != "" {
+		fmt.Fprintf(w, "Added node: %s\n", r.Added)
+	}
+	if r.Removed != "" {
+		fmt.Fprintf(w, "Removed node: %s\n", r.Removed)
+	}
+	if r.Ranges != nil {
+		fmt.Fprintf(w, "Moved ranges (%d):\n", len(r.Ranges))
+		for _, c := range r.Ranges {
+			fmt.Fprintf(w, "(%d, %d]: %s -> %s\n", c.Start, c.End, c.From, c.To)
+		}
+	}
+	fmt.Fprintln(w, "Key distribution:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "NODE\tWEIGHT\tKEYS\tIDEAL\tDEVIATION\t")
+	for _, s := range r.Nodes {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%+.1f%%\t\n", s.Node, s.Weight, s.Keys, s.Ideal, s.DeviationPct)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Mean: %.1f  StdDev: %.1f  Min/Max: %.3f\n", r.Mean, r.StdDev, r.MinMaxRatio)
+	if r.Added != "" || r.Removed != "" {
+		fmt.Fprintf(w, "Moved keys: %d (%.2f%%, ideal %.2f%%)\n", r.MovedKeys, r.MovedPct, r.IdealMovePct)
+	}
+	return nil
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+func fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
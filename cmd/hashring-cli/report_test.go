@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"shardo/pkg/hashring"
+)
+
+// points places virtual nodes and keys at fixed ring positions, so every
+// test below knows exactly which node owns which key.
+var points = map[string]uint64{
+	"a#0": 100, "b#0": 200, "c#0": 300, "d#0": 400, "c#1": 150,
+	"k1": 50, "k2": 150, "k3": 250, "k4": 260, "k5": 350, "k6": 380,
+}
+
+func tableHash(key string) uint64 { return points[key] }
+
+// ring builds a one-vnode-per-weight ring over points from "name" or
+// "name:weight" entries.
+func ring(t *testing.T, nodes ...string) *hashring.HashRing {
+	t.Helper()
+	h := hashring.New(1, hashring.WithHashFunc(tableHash))
+	for _, n := range nodes {
+		weight := 1
+		if len(n) > 2 && n[1] == ':' {
+			weight = int(n[2] - '0')
+			n = n[:1]
+		}
+		h.AddNodeWithWeight(n, weight, hashring.Labels{})
+	}
+	return h
+}
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-3 }
+
+func TestBuildReport(t *testing.T) {
+	keys := []string{"k1", "k2", "k3", "k4", "k5"}
+	cases := []struct {
+		name          string
+		before, after []string
+		keys          map[string]int
+		deviationPct  map[string]float64
+		stdDev        float64
+		minMax        float64
+		moved         int
+		movedPct      float64
+		idealPct      float64
+	}{
+		{
+			name:   "unchanged single node",
+			before: []string{"a"}, after: []string{"a"},
+			keys:         map[string]int{"a": 5},
+			deviationPct: map[string]float64{"a": 0},
+			minMax:       1,
+		},
+		{
+			// k3 and k4 sit past b and wrapped round to a until c arrived.
+			name:   "add a node",
+			before: []string{"a", "b"}, after: []string{"a", "b", "c"},
+			keys:         map[string]int{"a": 2, "b": 1, "c": 2},
+			deviationPct: map[string]float64{"a": 20, "b": -40, "c": 20},
+			stdDev:       math.Sqrt(2.0 / 9), minMax: 0.5,
+			moved: 2, movedPct: 40, idealPct: 100.0 / 3,
+		},
+		{
+			name:   "remove a node",
+			before: []string{"a", "b", "c"}, after: []string{"a", "c"},
+			keys:         map[string]int{"a": 2, "c": 3},
+			deviationPct: map[string]float64{"a": -20, "c": 20},
+			stdDev:       0.5, minMax: 2.0 / 3,
+			moved: 1, movedPct: 20, idealPct: 100.0 / 3,
+		},
+		{
+			// c's second vnode at 150 takes k2 from b.
+			name:   "weighted node",
+			before: []string{"a", "b", "c"}, after: []string{"a", "b", "c:2"},
+			keys:         map[string]int{"a": 2, "b": 0, "c": 3},
+			deviationPct: map[string]float64{"a": 60, "b": -100, "c": 20},
+			stdDev:       math.Sqrt(14.0 / 9), minMax: 0,
+			moved: 1, movedPct: 20, idealPct: 50 - 100.0/3,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := buildReport(ring(t, tc.before...), ring(t, tc.after...), keys)
+			if r.Keys != len(keys) || len(r.Nodes) != len(tc.keys) {
+				t.Fatalf("unexpected report %+v", r)
+			}
+			for _, s := range r.Nodes {
+				if s.Keys != tc.keys[s.Node] || !near(s.DeviationPct, tc.deviationPct[s.Node]) {
+					t.Fatalf("node %s: expected %d keys at %+.1f%%, got %+v", s.Node, tc.keys[s.Node], tc.deviationPct[s.Node], s)
+				}
+			}
+			if !near(r.StdDev, tc.stdDev) || !near(r.MinMaxRatio, tc.minMax) {
+				t.Fatalf("expected stddev %.3f and min/max %.3f, got %.3f and %.3f", tc.stdDev, tc.minMax, r.StdDev, r.MinMaxRatio)
+			}
+			if r.MovedKeys != tc.moved || !near(r.MovedPct, tc.movedPct) || !near(r.IdealMovePct, tc.idealPct) {
+				t.Fatalf("expected %d moved (%.2f%%, ideal %.2f%%), got %d (%.2f%%, ideal %.2f%%)",
+					tc.moved, tc.movedPct, tc.idealPct, r.MovedKeys, r.MovedPct, r.IdealMovePct)
+			}
+		})
+	}
+
+	if r := buildReport(ring(t), ring(t), keys); len(r.Nodes) != 0 || r.Mean != 0 || r.MovedKeys != 0 {
+		t.Fatalf("expected an empty report for empty rings, got %+v", r)
+	}
+}
+
+func TestIdealMovePct(t *testing.T) {
+	cases := []struct {
+		before, after []string
+		want          float64
+	}{
+		{[]string{"a", "b"}, []string{"a", "b"}, 0},
+		{[]string{"a", "b", "c"}, []string{"a", "b", "c", "d"}, 25},
+		{[]string{"a", "b", "c", "d"}, []string{"a", "b", "c"}, 25},
+		{[]string{"a", "b"}, []string{"a", "b", "c:2"}, 50},
+		{[]string{"a", "b"}, []string{"a:3", "b"}, 25},
+		{[]string{"a"}, []string{"b"}, 100},
+	}
+	for _, tc := range cases {
+		if got := idealMovePct(ring(t, tc.before...), ring(t, tc.after...)); !near(got, tc.want) {
+			t.Fatalf("%v -> %v: expected %.2f%%, got %.2f%%", tc.before, tc.after, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"shardo/pkg/hashring"
+)
+
+type simStep struct {
+	Step          int     `json:"step"`
+	Action        string  `json:"action"`
+	Nodes         int     `json:"nodes"`
+	MovedKeys     int     `json:"moved_keys"`
+	MovedPct      float64 `json:"moved_pct"`
+	IdealMovePct  float64 `json:"ideal_moved_pct"`
+	ReplicaMoves  int     `json:"replica_moves"`
+	StdDev        float64 `json:"stddev"`
+	MinMaxRatio   float64 `json:"min_max_ratio"`
+	MaxMeanRatio  float64 `json:"max_mean_ratio"`
+	CumulativePct float64 `json:"cumulative_moved_pct"`
+}
+
+func runSimulate(args []string) {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	nodesStr := fs.String("nodes", "", "Comma-separated list of initial node names")
+	ringFile := fs.String("ring", "", "Load the initial ring from a snapshot instead of --nodes")
+	virtualReplicas := fs.Int("replicas", 100, "Number of virtual replicas per node")
+	hashName := fs.String("hash", "sha256", "Ring hash function: sha256, xxhash, murmur3 or fnv1a")
+	scriptFile := fs.String("script", "", "File with one step per line: add <node> [weight], remove <node>, weight <node> <weight>")
+	steps := fs.String("steps", "", "Inline steps separated by ';', e.g. \"add node4;remove node1\"")
+	keysFile := fs.String("keys-file", "", "File with one key per line, '-' for stdin")
+	keys := fs.Int("keys", 10000, "Number of synthetic keys when --keys-file is not set")
+	replication := fs.Int("replication", 1, "Replication factor used to count replica moves")
+	format := fs.String("format", "table", "Output format: table, json or csv")
+	_ = fs.Parse(args)
+
+	if (*nodesStr == "" && *ringFile == "") || (*scriptFile == "" && *steps == "") {
+		fmt.Println("Usage: hashring-cli simulate --nodes node1,node2 | --ring ring.json --script steps.txt | --steps \"add node3;remove node1\" [--keys-file keys.txt|-] [--keys 10000] [--replication 2] [--format table|json|csv]")
+		os.Exit(1)
+	}
+
+	var ring *hashring.HashRing
+	if *ringFile != "" {
+		data, err := os.ReadFile(*ringFile)
+		if err != nil {
+			fail("Error reading ring: %v", err)
+		}
+		if ring, err = hashring.Load(data); err != nil {
+			fail("Error loading ring: %v", err)
+		}
+	} else {
+		hashFunc, ok := hashring.HashFuncByName(*hashName)
+		if !ok {
+			fail("Unknown hash function: %s", *hashName)
+		}
+		ring = hashring.New(*virtualReplicas, hashring.WithHashFunc(hashFunc))
+		for _, n := range strings.Split(*nodesStr, ",") {
+			ring.AddNode(n)
+		}
+	}
+
+	var script []string
+	if *scriptFile != "" {
+		data, err := os.ReadFile(*scriptFile)
+		if err != nil {
+			fail("Error reading script: %v", err)
+		}
+		script = strings.Split(string(data), "\n")
+	} else {
+		script = strings.Split(*steps, ";")
+	}
+
+	sample, err := loadKeys(*keysFile, *keys)
+	if err != nil {
+		fail("Error reading keys: %v", err)
+	}
+
+	initial, err := hashring.FromSnapshot(ring.Snapshot())
+	if err != nil {
+		fail("Error copying ring: %v", err)
+	}
+	var results []simStep
+	for _, line := range script {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		before, err := hashring.FromSnapshot(ring.Snapshot())
+		if err != nil {
+			fail("Error copying ring: %v", err)
+		}
+		if err := applyStep(ring, line); err != nil {
+			fail("Step %d (%s): %v", len(results)+1, line, err)
+		}
+		r := buildReport(before, ring, sample)
+		cumulative := buildReport(initial, ring, sample)
+		step := simStep{
+			Step:          len(results) + 1,
+			Action:        line,
+			Nodes:         len(r.Nodes),
+			MovedKeys:     r.MovedKeys,
+			MovedPct:      r.MovedPct,
+			IdealMovePct:  r.IdealMovePct,
+			ReplicaMoves:  replicaMoves(before, ring, sample, *replication),
+			StdDev:        r.StdDev,
+			MinMaxRatio:   r.MinMaxRatio,
+			CumulativePct: cumulative.MovedPct,
+		}
+		if r.Mean > 0 {
+			maxKeys := 0
+			for _, s := range r.Nodes {
+				maxKeys = max(maxKeys, s.Keys)
+			}
+			step.MaxMeanRatio = float64(maxKeys) / r.Mean
+		}
+		results = append(results, step)
+	}
+	if err := writeSimulation(os.Stdout, results, len(sample), *format); err != nil {
+		fail("Error writing report: %v", err)
+	}
+}
+
+func applyStep(ring *hashring.HashRing, line string) error {
+	fields := strings.Fields(line)
+	parseWeight := func(s string) (int, error) {
+		w, err := strconv.Atoi(s)
+		if err != nil || w <= 0 {
+			return 0, fmt.Errorf("invalid weight %q", s)
+		}
+		return w, nil
+	}
+	switch {
+	case fields[0] == "add" && (len(fields) == 2 || len(fields) == 3):
+		weight := 1
+		if len(fields) == 3 {
+			var err error
+			if weight, err = parseWeight(fields[2]); err != nil {
+				return err
+			}
+		}
+		ring.AddNodeWithWeight(fields[1], weight, hashring.Labels{})
+	case fields[0] == "remove" && len(fields) == 2:
+		ring.RemoveNode(fields[1])
+	case fields[0] == "weight" && len(fields) == 3:
+		weight, err := parseWeight(fields[2])
+		if err != nil {
+			return err
+		}
+		if ring.Weight(fields[1]) == 0 {
+			return fmt.Errorf("unknown node %s", fields[1])
+		}
+		ring.SetWeight(fields[1], weight)
+	default:
+		return fmt.Errorf("unrecognised step")
+	}
+	return nil
+}
+
+// replicaMoves counts the replica copies that would have to be created on a
+// node that did not hold them before the step.
+func replicaMoves(before, after *hashring.HashRing, keys []string, n int) int {
+	moves := 0
+	for _, k := range keys {
+		held := make(map[string]bool, n)
+		for _, node := range before.GetReplicas(k, n) {
+			held[node] = true
+		}
+		for _, node := range after.GetReplicas(k, n) {
+			if !held[node] {
+				moves++
+			}
+		}
+	}
+	return moves
+}
+
+func loadKeys(path string, synthetic int) ([]string, error) {
+	if path == "" {
+		keys := make([]string, synthetic)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("key%d", i)
+		}
+		return keys, nil
+	}
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var keys []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if k := strings.TrimSpace(scanner.Text()); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys, scanner.Err()
+}
+
+func writeSimulation(w io.Writer, steps []simStep, keys int, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"keys": keys, "steps": steps})
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"step", "action", "nodes", "moved_keys", "moved_pct", "ideal_moved_pct", "replica_moves", "stddev", "min_max_ratio", "max_mean_ratio", "cumulative_moved_pct"})
+		for _, s := range steps {
+			_ = cw.Write([]string{
+				strconv.Itoa(s.Step), s.Action, strconv.Itoa(s.Nodes), strconv.Itoa(s.MovedKeys),
+				formatFloat(s.MovedPct), formatFloat(s.IdealMovePct), strconv.Itoa(s.ReplicaMoves),
+				formatFloat(s.StdDev), formatFloat(s.MinMaxRatio), formatFloat(s.MaxMeanRatio), formatFloat(s.CumulativePct),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		fmt.Fprintf(w, "Simulating %d steps over %d keys\n", len(steps), keys)
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "STEP\tACTION\tNODES\tMOVED\tIDEAL\tREPLICA MOVES\tSTDDEV\tMIN/MAX\tMAX/MEAN\tCUMULATIVE")
+		for _, s := range steps {
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%d (%.2f%%)\t%.2f%%\t%d\t%.1f\t%.3f\t%.3f\t%.2f%%\n",
+				s.Step, s.Action, s.Nodes, s.MovedKeys, s.MovedPct, s.IdealMovePct, s.ReplicaMoves,
+				s.StdDev, s.MinMaxRatio, s.MaxMeanRatio, s.CumulativePct)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
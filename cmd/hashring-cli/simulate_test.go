@@ -0,0 +1,76 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestApplyStep(t *testing.T) {
+	cases := []struct {
+		step    string
+		nodes   []string
+		weights map[string]int
+		err     string
+	}{
+		{step: "add d", nodes: []string{"a", "b", "c", "d"}, weights: map[string]int{"d": 1}},
+		{step: "add c 2", nodes: []string{"a", "b", "c"}, weights: map[string]int{"c": 1}},
+		{step: "add d 3", nodes: []string{"a", "b", "c", "d"}, weights: map[string]int{"d": 3}},
+		{step: "remove b", nodes: []string{"a", "c"}},
+		{step: "remove z", nodes: []string{"a", "b", "c"}},
+		{step: "weight a 2", nodes: []string{"a", "b", "c"}, weights: map[string]int{"a": 2}},
+		{step: "add d 0", err: `invalid weight "0"`},
+		{step: "weight a x", err: `invalid weight "x"`},
+		{step: "weight z 2", err: "unknown node z"},
+		{step: "add", err: "unrecognised step"},
+		{step: "remove a b", err: "unrecognised step"},
+		{step: "drop a", err: "unrecognised step"},
+	}
+	for _, tc := range cases {
+		r := ring(t, "a", "b", "c")
+		err := applyStep(r, tc.step)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("%q: expected error %q, got %v", tc.step, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tc.step, err)
+		}
+		nodes := r.Nodes()
+		slices.Sort(nodes)
+		if !slices.Equal(nodes, tc.nodes) {
+			t.Fatalf("%q: expected nodes %v, got %v", tc.step, tc.nodes, nodes)
+		}
+		for n, w := range tc.weights {
+			if r.Weight(n) != w {
+				t.Fatalf("%q: expected %s to weigh %d, got %d", tc.step, n, w, r.Weight(n))
+			}
+		}
+	}
+}
+
+func TestReplicaMoves(t *testing.T) {
+	keys := []string{"k1", "k2", "k3", "k4", "k5", "k6"}
+	cases := []struct {
+		name          string
+		before, after []string
+		n             int
+		want          int
+	}{
+		{"unchanged", []string{"a", "b", "c"}, []string{"a", "b", "c"}, 2, 0},
+		// d at 400 becomes the primary of k5 and k6.
+		{"add, primaries only", []string{"a", "b", "c"}, []string{"a", "b", "c", "d"}, 1, 2},
+		// ...and also the second replica of k3 and k4, which wrapped to a.
+		{"add, two replicas", []string{"a", "b", "c"}, []string{"a", "b", "c", "d"}, 2, 4},
+		// c replaces b as second replica of k1, k5 and k6; a replaces it for k2.
+		{"remove, two replicas", []string{"a", "b", "c"}, []string{"a", "c"}, 2, 4},
+		{"replication beyond the ring", []string{"a", "b"}, []string{"a", "b", "c"}, 5, 6},
+	}
+	for _, tc := range cases {
+		if got := replicaMoves(ring(t, tc.before...), ring(t, tc.after...), keys, tc.n); got != tc.want {
+			t.Fatalf("%s: expected %d replica moves, got %d", tc.name, tc.want, got)
+		}
+	}
+}
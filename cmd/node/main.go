@@ -1,24 +1,137 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"os"
-	"strconv"
+	"os/signal"
+	"slices"
+	"sync/atomic"
+	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus"
+
+	"shardo/internal/auth"
+	"shardo/internal/config"
 	grpcserver "shardo/internal/grpc"
+	"shardo/internal/logging"
+	"shardo/internal/tlsutil"
+	"shardo/pkg/cache"
 )
 
 func main() {
-	port := os.Getenv("NODE_GRPC_PORT")
-	if port == "" {
-		port = "50051"
-	}
-	cacheSize := 128
-	if v := os.Getenv("CACHE_SIZE_MB"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			cacheSize = n
+	cfg, err := config.LoadNode(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := logging.Setup("shardo-node", cfg.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	var nodeTLS *tlsutil.Reloader
+	if cfg.TLS.Enabled() {
+		if nodeTLS, err = tlsutil.NewReloader(cfg.TLS.Files()); err != nil {
+			slog.Error("loading TLS certificates", "err", err)
+			os.Exit(1)
+		}
+	}
+	var guard *auth.NodeGuard
+	if cfg.Secret != "" || len(cfg.AllowedClients) > 0 {
+		guard = &auth.NodeGuard{Secret: cfg.Secret, AllowedClients: cfg.AllowedClients}
+	}
+	c := cache.NewWithOptions(cfg.CacheCapacity, cache.WithConstLabels(prometheus.Labels{"node": cfg.ID}))
+	applyQuotas(c, cfg.Namespaces, nil)
+	var allowed atomic.Pointer[map[string]bool]
+	allowed.Store(allowedNamespaces(cfg))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go reloadOnHangup(ctx, c, cfg, &allowed)
+
+	slog.Info("starting node", "id", cfg.ID, "port", cfg.Port, "cache_capacity", cfg.CacheCapacity)
+	err = grpcserver.StartGRPCServer(ctx, c, grpcserver.Config{
+		NodeID:          cfg.ID,
+		Port:            cfg.Port,
+		MetricsPort:     cfg.MetricsPort,
+		ShutdownTimeout: cfg.ShutdownTimeout.Duration,
+		TracesExporter:  cfg.TracesExporter,
+		TLS:             nodeTLS,
+		Guard:           guard,
+		AllowNamespace: func(name string) bool {
+			m := allowed.Load()
+			return *m == nil || (*m)[name]
+		},
+	})
+	if err != nil {
+		slog.Error("node failed", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("node stopped")
+}
+
+// reloadOnHangup re-reads the config on SIGHUP and applies the cache
+// capacity, namespace quotas, strict_namespaces and log level. Ports, the node id, TLS and the node guard need
+// a restart; certificate files are reloaded on their own when they change.
+func reloadOnHangup(ctx context.Context, c *cache.Cache, startup *config.Node, allowed *atomic.Pointer[map[string]bool]) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	quotas := startup.Namespaces
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := config.LoadNode(os.Args[1:])
+		if err != nil {
+			slog.Error("config reload failed, keeping current settings", "err", err)
+			continue
+		}
+		if cfg.Port != startup.Port || cfg.MetricsPort != startup.MetricsPort ||
+			cfg.ID != startup.ID || cfg.TLS != startup.TLS ||
+			cfg.Secret != startup.Secret || !slices.Equal(cfg.AllowedClients, startup.AllowedClients) {
+			slog.Warn("port, metrics_port, id, tls, secret and allowed_clients changes need a restart")
+		}
+		if err := logging.SetLevel(cfg.LogLevel); err != nil {
+			slog.Error("config reload failed, keeping current settings", "err", err)
+			continue
+		}
+		c.Resize(cfg.CacheCapacity)
+		applyQuotas(c, cfg.Namespaces, quotas)
+		quotas = cfg.Namespaces
+		allowed.Store(allowedNamespaces(cfg))
+		slog.Info("config reloaded", "cache_capacity", cfg.CacheCapacity, "namespaces", len(cfg.Namespaces),
+			"log_level", cfg.LogLevel)
+	}
+}
+
+// applyQuotas sets the configured namespace quotas and lifts those of
+// namespaces dropped from the config since previous.
+func applyQuotas(c *cache.Cache, quotas, previous []config.Quota) {
+	kept := make(map[string]bool, len(quotas))
+	for _, q := range quotas {
+		c.SetQuota(q.Name, cache.Quota{MaxKeys: q.MaxKeys, MaxBytes: q.MaxBytes})
+		kept[q.Name] = true
+	}
+	for _, q := range previous {
+		if !kept[q.Name] {
+			c.SetQuota(q.Name, cache.Quota{})
+		}
+	}
+}
+
+// allowedNamespaces returns the namespaces a node with strict_namespaces
+// serves, or nil when it serves any.
+func allowedNamespaces(cfg *config.Node) *map[string]bool {
+	var m map[string]bool
+	if cfg.StrictNamespaces {
+		m = make(map[string]bool, len(cfg.Namespaces))
+		for _, q := range cfg.Namespaces {
+			m[q.Name] = true
 		}
 	}
-	log.Printf("Starting node on port %s with cache size %dMB", port, cacheSize)
-	grpcserver.StartGRPCServer(port, cacheSize)
+	return &m
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"shardo/internal/auth"
+	"shardo/internal/tlsutil"
+	"shardo/proto/cachepb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const usage = `Usage: shardoctl [--gateway http://localhost:8080] [--nodes name=addr,...] [--timeout 5s]
+                 [--ca ca.pem] [--cert cert.pem --key key.pem] [--server-name name]
+                 [--api-key key | --token jwt] [--node-secret secret] [--namespace ns] <command> [args]
+
+Commands:
+  locate <key>             Show which nodes own a key and which one serves reads
+  get <key>                Read a key through the gateway
+  set <key> <value> <ttl>  Write a key through the gateway (ttl in seconds, > 0)
+  del <key>                Delete a key through the gateway
+  nodes                    List the gateway's nodes
+  ring                     Dump the ring the gateway is using
+  stats                    Query Stats on every node over gRPC and sum them
+  scan <prefix>            List keys with a prefix on every node over gRPC
+  flush                    Delete every key of the namespace (--namespace, default "default")
+  token <principal> [ttl]  Print an HMAC token signed with $SHARDO_HMAC_SECRET (ttl default 1h)
+
+With --ca or --cert, the gateway and nodes are reached over TLS, presenting
+the certificate when given. --server-name overrides the name expected in node
+certificates.
+
+--namespace picks the namespace keys live in; stats then reports only that
+namespace.
+
+--api-key, --token, --node-secret and --namespace default to $SHARDO_API_KEY,
+$SHARDO_TOKEN, $SHARDO_NODE_SECRET and $SHARDO_NAMESPACE.`
+
+type nodeInfo struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+	Zone   string `json:"zone,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+	Host   string `json:"host,omitempty"`
+}
+
+type client struct {
+	gateway    string
+	nodes      string
+	timeout    time.Duration
+	http       *http.Client
+	tls        *tlsutil.Reloader
+	serverName string
+	apiKey     string
+	token      string
+	nodeSecret string
+	namespace  string
+	out        io.Writer
+}
+
+// errUsage reports a command line that does not match any command.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+	case errors.Is(err, errUsage):
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(1)
+	default:
+		fmt.Fprintf(os.Stderr, "shardoctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	defaultGateway := os.Getenv("SHARDO_GATEWAY")
+	if defaultGateway == "" {
+		defaultGateway = "http://localhost:8080"
+	}
+	fs := flag.NewFlagSet("shardoctl", flag.ContinueOnError)
+	gateway := fs.String("gateway", defaultGateway, "Gateway base URL")
+	nodes := fs.String("nodes", "", "Comma-separated name=addr list for stats, instead of asking the gateway")
+	timeout := fs.Duration("timeout", 5*time.Second, "Request timeout")
+	caFile := fs.String("ca", "", "CA certificate that signed the gateway and node certificates")
+	certFile := fs.String("cert", "", "Client certificate for mutual TLS")
+	keyFile := fs.String("key", "", "Client key for mutual TLS")
+	serverName := fs.String("server-name", "", "Name expected in node certificates")
+	apiKey := fs.String("api-key", os.Getenv("SHARDO_API_KEY"), "API key sent to the gateway")
+	token := fs.String("token", os.Getenv("SHARDO_TOKEN"), "Bearer token sent to the gateway")
+	nodeSecret := fs.String("node-secret", os.Getenv("SHARDO_NODE_SECRET"), "Shared secret sent to nodes")
+	namespace := fs.String("namespace", os.Getenv("SHARDO_NAMESPACE"), "Namespace the keys live in")
+	fs.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	c := &client{
+		gateway:    strings.TrimRight(*gateway, "/"),
+		nodes:      *nodes,
+		timeout:    *timeout,
+		http:       &http.Client{Timeout: *timeout},
+		serverName: *serverName,
+		apiKey:     *apiKey,
+		token:      *token,
+		nodeSecret: *nodeSecret,
+		namespace:  *namespace,
+		out:        out,
+	}
+	if *caFile != "" || *certFile != "" {
+		r, err := tlsutil.NewReloader(tlsutil.Files{CA: *caFile, Cert: *certFile, Key: *keyFile})
+		if err != nil {
+			return err
+		}
+		c.tls = r
+		c.http.Transport = &http.Transport{TLSClientConfig: r.ClientConfig("")}
+	}
+	switch cmd, rest := args[0], args[1:]; {
+	case cmd == "locate" && len(rest) == 1:
+		return c.locate(rest[0])
+	case cmd == "get" && len(rest) == 1:
+		return c.get(rest[0])
+	case cmd == "set" && len(rest) == 3:
+		ttl, err := strconv.Atoi(rest[2])
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid ttl %q: want a positive number of seconds", rest[2])
+		}
+		return c.set(rest[0], rest[1], ttl)
+	case cmd == "del" && len(rest) == 1:
+		return c.del(rest[0])
+	case cmd == "nodes" && len(rest) == 0:
+		return c.listNodes()
+	case cmd == "ring" && len(rest) == 0:
+		return c.ring()
+	case cmd == "stats" && len(rest) == 0:
+		return c.stats()
+	case cmd == "scan" && len(rest) <= 1:
+		prefix := ""
+		if len(rest) == 1 {
+			prefix = rest[0]
+		}
+		return c.scan(prefix)
+	case cmd == "flush" && len(rest) == 0:
+		return c.flush()
+	case cmd == "token" && (len(rest) == 1 || len(rest) == 2):
+		ttl := "1h"
+		if len(rest) == 2 {
+			ttl = rest[1]
+		}
+		return printToken(out, rest[0], ttl)
+	default:
+		return errUsage
+	}
+}
+
+func (c *client) do(method, path string, query url.Values, body []byte) ([]byte, int, error) {
+	u := c.gateway + path
+	if c.namespace != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("namespace", c.namespace)
+	}
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set(auth.APIKeyHeader, c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return data, resp.StatusCode, err
+}
+
+func (c *client) getJSON(path string, query url.Values, out interface{}) error {
+	data, status, err := c.do(http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("%s: %d %s", path, status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *client) locate(key string) error {
+	var loc struct {
+		Key      string   `json:"key"`
+		Owner    string   `json:"owner"`
+		Replicas []string `json:"replicas"`
+		Read     []string `json:"read"`
+		Epoch    uint64   `json:"epoch"`
+	}
+	if err := c.getJSON("/locate", url.Values{"key": {key}}, &loc); err != nil {
+		return err
+	}
+	read := loc.Owner
+	if len(loc.Read) > 0 {
+		read = loc.Read[0]
+	}
+	_, err := fmt.Fprintf(c.out, "%s -> %s (owner: %s, replicas: %s, ring epoch %d)\n",
+		loc.Key, read, loc.Owner, strings.Join(loc.Replicas, ", "), loc.Epoch)
+	return err
+}
+
+func (c *client) get(key string) error {
+	data, status, err := c.do(http.MethodGet, "/get", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("get %s: %d %s", key, status, strings.TrimSpace(string(data)))
+	}
+	_, err = c.out.Write(append(data, '\n'))
+	return err
+}
+
+func (c *client) set(key, value string, ttl int) error {
+	data, status, err := c.do(http.MethodPost, "/set", url.Values{"key": {key}, "ttl": {strconv.Itoa(ttl)}}, []byte(value))
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("set %s: %d %s", key, status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func (c *client) del(key string) error {
+	data, status, err := c.do(http.MethodDelete, "/delete", url.Values{"key": {key}}, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("del %s: %d %s", key, status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func (c *client) listNodes() error {
+	var nodes []nodeInfo
+	if err := c.getJSON("/nodes", nil, &nodes); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDR\tWEIGHT\tZONE\tRACK\tHOST")
+	for _, n := range nodes {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", n.Name, n.Addr, n.Weight, n.Zone, n.Rack, n.Host)
+	}
+	return tw.Flush()
+}
+
+func (c *client) ring() error {
+	data, status, err := c.do(http.MethodGet, "/ring", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("ring: %d %s", status, strings.TrimSpace(string(data)))
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return err
+	}
+	_, err = out.WriteTo(c.out)
+	return err
+}
+
+func (c *client) nodeAddrs() ([]nodeInfo, error) {
+	if c.nodes == "" {
+		var nodes []nodeInfo
+		err := c.getJSON("/nodes", nil, &nodes)
+		return nodes, err
+	}
+	var nodes []nodeInfo
+	for _, pair := range strings.Split(c.nodes, ",") {
+		name, addr, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid node %q, want name=addr", pair)
+		}
+		nodes = append(nodes, nodeInfo{Name: name, Addr: addr})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes, nil
+}
+
+func (c *client) stats() error {
+	nodes, err := c.nodeAddrs()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "NODE\tHITS\tMISSES\tHIT RATIO\tSIZE\tCAPACITY\tBYTES\tEVICTIONS\tEXPIRATIONS\tUPTIME\t")
+	var total cachepb.StatsResponse
+	failed := 0
+	for _, n := range nodes {
+		var st *cachepb.StatsResponse
+		err := c.withNode(n.Addr, func(ctx context.Context, client cachepb.CacheServiceClient) error {
+			var err error
+			st, err = client.Stats(ctx, &cachepb.StatsRequest{Namespace: c.namespace})
+			return err
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shardoctl: %s (%s): %v\n", n.Name, n.Addr, err)
+			failed++
+			continue
+		}
+		total.Hits += st.Hits
+		total.Misses += st.Misses
+		total.Size += st.Size
+		total.Capacity += st.Capacity
+		total.Bytes += st.Bytes
+		total.Evictions += st.Evictions
+		total.Expirations += st.Expirations
+		printStats(tw, n.Name, st)
+	}
+	printStats(tw, "TOTAL", &total)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d nodes unreachable", failed, len(nodes))
+	}
+	return nil
+}
+
+func printStats(w io.Writer, name string, st *cachepb.StatsResponse) {
+	uptime := "-"
+	if st.UptimeSeconds > 0 {
+		uptime = (time.Duration(st.UptimeSeconds) * time.Second).String()
+	}
+	fmt.Fprintf(w, "%s\t%d\t%d\t%.3f\t%d\t%d\t%d\t%d\t%d\t%s\t\n", name, st.Hits, st.Misses, hitRatio(st.Hits, st.Misses),
+		st.Size, st.Capacity, st.Bytes, st.Evictions, st.Expirations, uptime)
+}
+
+func (c *client) scan(prefix string) error {
+	nodes, err := c.nodeAddrs()
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		err := c.withNode(n.Addr, func(ctx context.Context, client cachepb.CacheServiceClient) error {
+			stream, err := client.Scan(ctx, &cachepb.ScanRequest{Prefix: prefix, Namespace: c.namespace})
+			if err != nil {
+				return err
+			}
+			for {
+				resp, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(c.out, "%s\t%s\t%s\n", n.Name, resp.Key, time.Duration(resp.TtlMs)*time.Millisecond)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%s (%s): %w", n.Name, n.Addr, err)
+		}
+	}
+	return nil
+}
+
+func (c *client) flush() error {
+	var res struct {
+		Namespace     string   `json:"namespace"`
+		RemovedCopies int64    `json:"removed_copies"`
+		Failed        []string `json:"failed"`
+	}
+	data, status, err := c.do(http.MethodPost, "/flush", nil, nil)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("flush: %d %s", status, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.out, "flushed %d key copies from namespace %s\n", res.RemovedCopies, res.Namespace); err != nil {
+		return err
+	}
+	if len(res.Failed) > 0 {
+		return fmt.Errorf("flush: failed on %s, their keys are still there", strings.Join(res.Failed, ", "))
+	}
+	return nil
+}
+
+func (c *client) withNode(addr string, fn func(context.Context, cachepb.CacheServiceClient) error) error {
+	creds := insecure.NewCredentials()
+	if c.tls != nil {
+		creds = credentials.NewTLS(c.tls.ClientConfig(c.serverName))
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if c.nodeSecret != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(auth.NodeSecret(c.nodeSecret)))
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	return fn(ctx, cachepb.NewCacheServiceClient(conn))
+}
+
+func printToken(out io.Writer, principal, ttl string) error {
+	secret := os.Getenv("SHARDO_HMAC_SECRET")
+	if secret == "" {
+		return errors.New("SHARDO_HMAC_SECRET is not set")
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return err
+	}
+	token, err := auth.SignHMAC([]byte(secret), principal, d)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, token)
+	return err
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"shardo/internal/auth"
+)
+
+// fakeGateway answers the gateway routes shardoctl uses and records every
+// request it gets as "METHOD path?query body".
+type fakeGateway struct {
+	mu   sync.Mutex
+	seen []string
+}
+
+func (f *fakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	f.seen = append(f.seen, strings.TrimSpace(r.Method+" "+r.URL.RequestURI()+" "+string(body)))
+	f.mu.Unlock()
+	if r.Header.Get(auth.APIKeyHeader) != "k1" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/get":
+		if r.URL.Query().Get("key") != "foo" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, "bar")
+	case "/set", "/delete":
+	case "/locate":
+		io.WriteString(w, `{"key":"foo","owner":"n1","replicas":["n1","n2"],"read":["n2","n1"],"epoch":3}`)
+	case "/nodes":
+		io.WriteString(w, `[{"name":"n1","addr":"h1:1","weight":1,"zone":"a"},{"name":"n2","addr":"h2:1","weight":2}]`)
+	case "/flush":
+		if r.URL.Query().Get("namespace") == "half" {
+			io.WriteString(w, `{"namespace":"half","removed_copies":2,"flushed":["n1"],"failed":["n2"]}`)
+			return
+		}
+		io.WriteString(w, `{"namespace":"team-a","removed_copies":4,"flushed":["n1","n2"]}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	for _, env := range []string{"SHARDO_API_KEY", "SHARDO_TOKEN", "SHARDO_NODE_SECRET", "SHARDO_NAMESPACE"} {
+		t.Setenv(env, "")
+	}
+	gw := &fakeGateway{}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+	cases := []struct {
+		args    []string
+		out     string // substring of the output
+		err     string // substring of the error
+		request string // request the gateway should see, "" for none
+	}{
+		{args: []string{"get", "foo"}, out: "bar\n", request: "GET /get?key=foo"},
+		{args: []string{"get", "nope"}, err: "get nope: 404 not found", request: "GET /get?key=nope"},
+		{args: []string{"set", "foo", "bar", "60"}, request: "POST /set?key=foo&ttl=60 bar"},
+		{args: []string{"--namespace", "team-a", "set", "foo", "bar", "5"}, request: "POST /set?key=foo&namespace=team-a&ttl=5 bar"},
+		{args: []string{"set", "foo", "bar"}, err: errUsage.Error()},
+		{args: []string{"set", "foo", "bar", "0"}, err: `invalid ttl "0"`},
+		{args: []string{"set", "foo", "bar", "-5"}, err: `invalid ttl "-5"`},
+		{args: []string{"set", "foo", "bar", "1h"}, err: `invalid ttl "1h"`},
+		{args: []string{"del", "foo"}, request: "DELETE /delete?key=foo"},
+		{args: []string{"locate", "foo"}, out: "foo -> n2 (owner: n1, replicas: n1, n2, ring epoch 3)", request: "GET /locate?key=foo"},
+		{args: []string{"nodes"}, out: "n2    h2:1  2", request: "GET /nodes"},
+		{args: []string{"--namespace", "team-a", "flush"}, out: "flushed 4 key copies from namespace team-a", request: "POST /flush?namespace=team-a"},
+		{args: []string{"--namespace", "half", "flush"}, out: "flushed 2 key copies", err: "flush: failed on n2", request: "POST /flush?namespace=half"},
+		{args: []string{"--api-key", "", "get", "foo"}, err: "401 unauthorized", request: "GET /get?key=foo"},
+		{args: []string{"unknown"}, err: errUsage.Error()},
+		{args: nil, err: errUsage.Error()},
+	}
+	for _, tc := range cases {
+		gw.seen = nil
+		var out bytes.Buffer
+		args := append([]string{"--gateway", srv.URL, "--api-key", "k1"}, tc.args...)
+		err := run(args, &out)
+		if tc.err == "" && err != nil {
+			t.Fatalf("%v: %v", tc.args, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Fatalf("%v: expected error %q, got %v", tc.args, tc.err, err)
+		}
+		if !strings.Contains(out.String(), tc.out) {
+			t.Fatalf("%v: expected %q in output, got %q", tc.args, tc.out, out.String())
+		}
+		var want []string
+		if tc.request != "" {
+			want = []string{tc.request}
+		}
+		if strings.Join(gw.seen, "|") != strings.Join(want, "|") {
+			t.Fatalf("%v: expected the gateway to see %q, got %q", tc.args, want, gw.seen)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	t.Setenv("SHARDO_HMAC_SECRET", "")
+	if err := run([]string{"token", "team-a"}, io.Discard); err == nil || !strings.Contains(err.Error(), "SHARDO_HMAC_SECRET") {
+		t.Fatalf("expected a missing secret error, got %v", err)
+	}
+	t.Setenv("SHARDO_HMAC_SECRET", "s3cret")
+	var out bytes.Buffer
+	if err := run([]string{"token", "team-a", "5m"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(strings.TrimSpace(out.String()), ".") != 2 {
+		t.Fatalf("expected a signed token, got %q", out.String())
+	}
+	if err := run([]string{"-no-such-flag"}, io.Discard); err == nil || errors.Is(err, errUsage) {
+		t.Fatalf("expected a flag error, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// Package auth authenticates gateway clients, checks them against a
+// per-prefix policy, and guards nodes so they only serve gateways.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type Operation string
+
+const (
+	OpRead  Operation = "read"
+	OpWrite Operation = "write"
+	OpAdmin Operation = "admin" // cluster-wide routes such as /nodes and /ring
+)
+
+// APIKeyHeader carries a static API key.
+const APIKeyHeader = "X-API-Key"
+
+var (
+	ErrNoCredentials = errors.New("auth: no credentials")
+	ErrForbidden     = errors.New("auth: forbidden")
+)
+
+// Authenticator identifies the principal behind a request. It returns
+// ErrNoCredentials when the request carries none of the credentials it
+// understands, and another error when they are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal string, err error)
+}
+
+// APIKeys authenticates static keys sent in the X-API-Key header. Keys are
+// stored hashed so lookups do not leak them through timing.
+type APIKeys struct {
+	principals map[[sha256.Size]byte]string
+}
+
+// NewAPIKeys takes a map of key to principal.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	k := &APIKeys{principals: make(map[[sha256.Size]byte]string, len(keys))}
+	for key, principal := range keys {
+		k.principals[sha256.Sum256([]byte(key))] = principal
+	}
+	return k
+}
+
+func (k *APIKeys) Authenticate(r *http.Request) (string, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return "", ErrNoCredentials
+	}
+	principal, ok := k.principals[sha256.Sum256([]byte(key))]
+	if !ok {
+		return "", errors.New("auth: unknown API key")
+	}
+	return principal, nil
+}
+
+// Rule grants a principal operations on keys starting with one of Prefixes.
+// Principal "*" matches every authenticated principal and the prefix ""
+// matches every key. Admin operations are not tied to keys.
+type Rule struct {
+	Principal  string
+	Namespaces []string // empty means every namespace
+	Prefixes   []string
+	Operations []Operation
+}
+
+// Policy allows what any of its rules allows and denies everything else.
+type Policy []Rule
+
+// Allows reports whether principal may perform op on key in namespace.
+// Admin operations are not namespaced.
+func (p Policy) Allows(principal string, op Operation, namespace, key string) bool {
+	for _, rule := range p {
+		if rule.Principal != "*" && rule.Principal != principal {
+			continue
+		}
+		if !rule.grants(op) {
+			continue
+		}
+		if op == OpAdmin {
+			return true
+		}
+		if len(rule.Namespaces) > 0 && !slices.Contains(rule.Namespaces, namespace) {
+			continue
+		}
+		for _, prefix := range rule.Prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r Rule) grants(op Operation) bool {
+	for _, o := range r.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Guard authenticates requests with the first authenticator that finds
+// credentials and checks the principal against the policy.
+type Guard struct {
+	authenticators []Authenticator
+	policy         Policy
+}
+
+func NewGuard(policy Policy, authenticators ...Authenticator) *Guard {
+	return &Guard{authenticators: authenticators, policy: policy}
+}
+
+// Authorize returns the principal allowed to perform op on key in
+// namespace, or ErrNoCredentials, ErrForbidden or the authenticator's error.
+func (g *Guard) Authorize(r *http.Request, op Operation, namespace, key string) (string, error) {
+	for _, a := range g.authenticators {
+		principal, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !g.policy.Allows(principal, op, namespace, key) {
+			return principal, ErrForbidden
+		}
+		return principal, nil
+	}
+	return "", ErrNoCredentials
+}
+
+type principalKey struct{}
+
+// WithPrincipal records the authenticated principal in ctx.
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the principal recorded by WithPrincipal, if any.
+func Principal(ctx context.Context) (string, bool) {
+	p, ok := ctx.Value(principalKey{}).(string)
+	return p, ok
+}
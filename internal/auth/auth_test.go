@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestGuardAuthorize(t *testing.T) {
+	secret := []byte("hmac-secret")
+	guard := NewGuard(Policy{
+		{Principal: "team-a", Namespaces: []string{"team-a"}, Prefixes: []string{"a:"}, Operations: []Operation{OpRead, OpWrite}},
+		{Principal: "ops", Operations: []Operation{OpAdmin}},
+		{Principal: "*", Prefixes: []string{"public:"}, Operations: []Operation{OpRead}},
+	}, NewAPIKeys(map[string]string{"key-a": "team-a", "key-ops": "ops"}), NewTokens(TokenOptions{HMACSecret: secret}))
+
+	tokenB, err := SignHMAC(secret, "team-b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := SignHMAC(secret, "team-a", -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := SignHMAC([]byte("other"), "team-a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		header string
+		value  string
+		op     Operation
+		ns     string
+		key    string
+		want   string
+		err    error
+	}{
+		{"no credentials", "", "", OpRead, "team-a", "a:1", "", ErrNoCredentials},
+		{"unknown key", APIKeyHeader, "nope", OpRead, "team-a", "a:1", "", errAny},
+		{"own prefix", APIKeyHeader, "key-a", OpWrite, "team-a", "a:1", "team-a", nil},
+		{"other prefix", APIKeyHeader, "key-a", OpWrite, "team-a", "b:1", "team-a", ErrForbidden},
+		{"other namespace", APIKeyHeader, "key-a", OpRead, "team-b", "a:1", "team-a", ErrForbidden},
+		{"admin without grant", APIKeyHeader, "key-a", OpAdmin, "", "", "team-a", ErrForbidden},
+		{"admin", APIKeyHeader, "key-ops", OpAdmin, "", "", "ops", nil},
+		{"wildcard rule", "Authorization", "Bearer " + tokenB, OpRead, "default", "public:x", "team-b", nil},
+		{"wildcard rule in any namespace", "Authorization", "Bearer " + tokenB, OpRead, "team-a", "public:x", "team-b", nil},
+		{"wildcard rule is read only", "Authorization", "Bearer " + tokenB, OpWrite, "default", "public:x", "team-b", ErrForbidden},
+		{"expired token", "Authorization", "Bearer " + expired, OpRead, "team-a", "a:1", "", errAny},
+		{"forged token", "Authorization", "Bearer " + forged, OpRead, "team-a", "a:1", "", errAny},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/get", nil)
+			if tc.header != "" {
+				r.Header.Set(tc.header, tc.value)
+			}
+			principal, err := guard.Authorize(r, tc.op, tc.ns, tc.key)
+			switch {
+			case tc.err == errAny && (err == nil || errors.Is(err, ErrNoCredentials) || errors.Is(err, ErrForbidden)):
+				t.Fatalf("expected invalid credentials, got %v", err)
+			case tc.err != errAny && !errors.Is(err, tc.err):
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			if principal != tc.want {
+				t.Fatalf("expected principal %q, got %q", tc.want, principal)
+			}
+		})
+	}
+}
+
+var errAny = errors.New("any authentication error")
+
+func TestTokensWithJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "OKP", "kid": "ed1", "crv": "Ed25519", "x": %q},
+		{"kty": "RSA", "kid": "enc1", "use": "enc", "n": "AQAB", "e": "AQAB"}
+	]}`, b64(ecKey.X.FillBytes(make([]byte, 32))), b64(ecKey.Y.FillBytes(make([]byte, 32))), b64(edPub))
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("expected the encryption key to be skipped, got %d keys", len(keys))
+	}
+	tokens := NewTokens(TokenOptions{Keys: keys, Issuer: "idp", Audience: "shardo"})
+
+	sign := func(method jwt.SigningMethod, kid string, key any, claims jwt.RegisteredClaims) string {
+		tok := jwt.NewWithClaims(method, claims)
+		tok.Header["kid"] = kid
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	valid := jwt.RegisteredClaims{
+		Subject:   "svc",
+		Issuer:    "idp",
+		Audience:  jwt.ClaimStrings{"shardo"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+	wrongAudience := valid
+	wrongAudience.Audience = jwt.ClaimStrings{"other"}
+	hmac, err := SignHMAC([]byte("secret"), "svc", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"ES256", sign(jwt.SigningMethodES256, "ec1", ecKey, valid), true},
+		{"EdDSA", sign(jwt.SigningMethodEdDSA, "ed1", edKey, valid), true},
+		{"unknown kid", sign(jwt.SigningMethodES256, "ec2", ecKey, valid), false},
+		{"key of another kid", sign(jwt.SigningMethodEdDSA, "ec1", edKey, valid), false},
+		{"wrong audience", sign(jwt.SigningMethodES256, "ec1", ecKey, wrongAudience), false},
+		{"HMAC not configured", hmac, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/get", nil)
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+			principal, err := tokens.Authenticate(r)
+			if tc.ok && (err != nil || principal != "svc") {
+				t.Fatalf("expected svc, got %q, %v", principal, err)
+			}
+			if !tc.ok && err == nil {
+				t.Fatal("expected the token to be rejected")
+			}
+		})
+	}
+}
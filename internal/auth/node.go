@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"slices"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// nodeSecretKey is the gRPC metadata key carrying the shared node secret.
+const nodeSecretKey = "x-shardo-node-secret"
+
+// NodeSecret sends the shared node secret with every RPC. Use it over TLS
+// outside of trusted networks.
+func NodeSecret(secret string) credentials.PerRPCCredentials {
+	return nodeSecret(secret)
+}
+
+type nodeSecret string
+
+func (s nodeSecret) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{nodeSecretKey: string(s)}, nil
+}
+
+func (nodeSecret) RequireTransportSecurity() bool { return false }
+
+// NodeGuard makes a node serve gateways only. With Secret set, RPCs must
+// carry it; with AllowedClients set, the TLS client certificate must name
+// one of them in its common name or DNS names.
+type NodeGuard struct {
+	Secret         string
+	AllowedClients []string
+}
+
+func (g NodeGuard) check(ctx context.Context) error {
+	if g.Secret != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		got := md.Get(nodeSecretKey)
+		if len(got) != 1 || subtle.ConstantTimeCompare([]byte(got[0]), []byte(g.Secret)) != 1 {
+			return status.Error(codes.Unauthenticated, "missing or invalid node secret")
+		}
+	}
+	if len(g.AllowedClients) > 0 {
+		if !g.allowedPeer(ctx) {
+			return status.Error(codes.PermissionDenied, "client certificate is not allowed")
+		}
+	}
+	return nil
+}
+
+func (g NodeGuard) allowedPeer(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return false
+	}
+	cert := info.State.PeerCertificates[0]
+	if slices.Contains(g.AllowedClients, cert.Subject.CommonName) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if slices.Contains(g.AllowedClients, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g NodeGuard) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := g.check(ctx); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (g NodeGuard) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := g.check(ss.Context()); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,665 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"shardo/internal/tlsutil"
+	"shardo/pkg/cache"
+	"shardo/pkg/hashring"
+)
+
+// Duration is a time.Duration written as "2s" or "1m30s" in config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Member is a cache node as seen by the gateway.
+type Member struct {
+	Name   string `yaml:"name" toml:"name"`
+	Addr   string `yaml:"addr" toml:"addr"`
+	Zone   string `yaml:"zone" toml:"zone"`
+	Rack   string `yaml:"rack" toml:"rack"`
+	Host   string `yaml:"host" toml:"host"`
+	Weight int    `yaml:"weight" toml:"weight"`
+}
+
+// ServerTLS turns on TLS for a listener. With ClientCAFile set, clients
+// must present a certificate signed by it.
+type ServerTLS struct {
+	CertFile     string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile      string `yaml:"key_file" toml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+}
+
+func (t ServerTLS) Enabled() bool { return t.CertFile != "" || t.KeyFile != "" }
+
+func (t ServerTLS) Files() tlsutil.Files {
+	return tlsutil.Files{CA: t.ClientCAFile, Cert: t.CertFile, Key: t.KeyFile}
+}
+
+// ClientTLS turns on TLS when dialing nodes. CertFile and KeyFile add a
+// client certificate for mutual TLS; without CAFile the system roots are
+// trusted.
+type ClientTLS struct {
+	CAFile     string `yaml:"ca_file" toml:"ca_file"`
+	CertFile   string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile    string `yaml:"key_file" toml:"key_file"`
+	ServerName string `yaml:"server_name" toml:"server_name"`
+}
+
+func (t ClientTLS) Enabled() bool { return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" }
+
+func (t ClientTLS) Files() tlsutil.Files {
+	return tlsutil.Files{CA: t.CAFile, Cert: t.CertFile, Key: t.KeyFile}
+}
+
+// Auth turns on gateway authentication when any credential source is set.
+// Requests must then authenticate and pass Policy.
+type Auth struct {
+	APIKeys    []APIKey     `yaml:"api_keys" toml:"api_keys"`
+	HMACSecret string       `yaml:"hmac_secret" toml:"hmac_secret"`
+	JWKSFile   string       `yaml:"jwks_file" toml:"jwks_file"`
+	Issuer     string       `yaml:"issuer" toml:"issuer"`
+	Audience   string       `yaml:"audience" toml:"audience"`
+	Policy     []PolicyRule `yaml:"policy" toml:"policy"`
+}
+
+type APIKey struct {
+	Key       string `yaml:"key" toml:"key"`
+	Principal string `yaml:"principal" toml:"principal"`
+}
+
+// PolicyRule grants Principal, or "*" for anyone authenticated, the listed
+// operations on keys starting with one of Prefixes, in any of Namespaces or
+// in every namespace when it is empty.
+type PolicyRule struct {
+	Principal  string   `yaml:"principal" toml:"principal"`
+	Namespaces []string `yaml:"namespaces" toml:"namespaces"`
+	Prefixes   []string `yaml:"prefixes" toml:"prefixes"`
+	Operations []string `yaml:"operations" toml:"operations"`
+}
+
+// RateLimit throttles each client, by principal or by IP when auth is off,
+// and caps the requests in flight. Zero values disable each limit.
+type RateLimit struct {
+	RequestsPerSecond float64  `yaml:"requests_per_second" toml:"requests_per_second"`
+	Burst             int      `yaml:"burst" toml:"burst"`
+	TrustProxy        bool     `yaml:"trust_proxy" toml:"trust_proxy"`
+	MaxConcurrency    int      `yaml:"max_concurrency" toml:"max_concurrency"`
+	MinConcurrency    int      `yaml:"min_concurrency" toml:"min_concurrency"`
+	TargetLatency     Duration `yaml:"target_latency" toml:"target_latency"`
+}
+
+func (a Auth) Enabled() bool { return len(a.APIKeys) > 0 || a.HMACSecret != "" || a.JWKSFile != "" }
+
+type Gateway struct {
+	Port              string    `yaml:"port" toml:"port"`
+	Zone              string    `yaml:"zone" toml:"zone"`
+	Nodes             []Member  `yaml:"nodes" toml:"nodes"`
+	VirtualReplicas   int       `yaml:"virtual_replicas" toml:"virtual_replicas"`
+	ReplicationFactor int       `yaml:"replication_factor" toml:"replication_factor"`
+	LoadEpsilon       float64   `yaml:"load_epsilon" toml:"load_epsilon"`
+	HashFunc          string    `yaml:"hash_func" toml:"hash_func"`
+	RingFile          string    `yaml:"ring_file" toml:"ring_file"`
+	RequestTimeout    Duration  `yaml:"request_timeout" toml:"request_timeout"`
+	ShutdownTimeout   Duration  `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	LogLevel          string    `yaml:"log_level" toml:"log_level"`
+	TracesExporter    string    `yaml:"traces_exporter" toml:"traces_exporter"`
+	TLS               ServerTLS `yaml:"tls" toml:"tls"`
+	NodeTLS           ClientTLS `yaml:"node_tls" toml:"node_tls"`
+	Auth              Auth      `yaml:"auth" toml:"auth"`
+	NodeSecret        string    `yaml:"node_secret" toml:"node_secret"`
+	RateLimit         RateLimit `yaml:"rate_limit" toml:"rate_limit"`
+}
+
+type Node struct {
+	ID               string    `yaml:"id" toml:"id"`
+	Port             string    `yaml:"port" toml:"port"`
+	MetricsPort      string    `yaml:"metrics_port" toml:"metrics_port"`
+	CacheCapacity    int       `yaml:"cache_capacity" toml:"cache_capacity"`
+	ShutdownTimeout  Duration  `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	LogLevel         string    `yaml:"log_level" toml:"log_level"`
+	TracesExporter   string    `yaml:"traces_exporter" toml:"traces_exporter"`
+	TLS              ServerTLS `yaml:"tls" toml:"tls"`
+	Secret           string    `yaml:"secret" toml:"secret"`
+	AllowedClients   []string  `yaml:"allowed_clients" toml:"allowed_clients"`
+	Namespaces       []Quota   `yaml:"namespaces" toml:"namespaces"`
+	StrictNamespaces bool      `yaml:"strict_namespaces" toml:"strict_namespaces"` // refuse namespaces not in Namespaces
+}
+
+// Quota caps one namespace on a node. A zero limit means none.
+type Quota struct {
+	Name     string `yaml:"name" toml:"name"`
+	MaxKeys  int    `yaml:"max_keys" toml:"max_keys"`
+	MaxBytes int64  `yaml:"max_bytes" toml:"max_bytes"`
+}
+
+// setting is a value that can be overridden from the environment or the
+// command line. Flags win over env vars, which win over the file.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(string) error
+}
+
+// LoadGateway builds the gateway config from defaults, the file named by
+// -config or SHARDO_CONFIG, env vars and flags, in increasing precedence.
+func LoadGateway(args []string) (*Gateway, error) {
+	c := &Gateway{
+		Port:              "8080",
+		VirtualReplicas:   100,
+		ReplicationFactor: 1,
+		HashFunc:          "sha256",
+		RequestTimeout:    Duration{2 * time.Second},
+		ShutdownTimeout:   Duration{15 * time.Second},
+		LogLevel:          "info",
+	}
+	settings := []setting{
+		{env: "GATEWAY_HTTP_PORT", flag: "port", usage: "HTTP listen port", set: setString(&c.Port)},
+		{env: "NODES", flag: "nodes", usage: "cache nodes as name:host:port,...", set: c.setNodes},
+		{env: "NODE_LABELS", usage: "node placement labels as name:zone=a;rack=r1,...", set: c.setLabels},
+		{env: "GATEWAY_ZONE", flag: "zone", usage: "zone the gateway runs in", set: setString(&c.Zone)},
+		{env: "HASHRING_VIRTUAL_REPLICAS", usage: "virtual nodes per node", set: setInt(&c.VirtualReplicas)},
+		{env: "SHARDO_REPLICATION_FACTOR", flag: "replication-factor", usage: "copies kept of each key", set: setInt(&c.ReplicationFactor)},
+		{env: "SHARDO_LOAD_EPSILON", usage: "bounded-load epsilon, 0 disables it", set: setFloat(&c.LoadEpsilon)},
+		{env: "SHARDO_HASH_FUNC", usage: "ring hash function", set: setString(&c.HashFunc)},
+		{env: "RING_FILE", usage: "ring exported with hashring-cli", set: setString(&c.RingFile)},
+		{env: "SHARDO_REQUEST_TIMEOUT", usage: "timeout of each call to a node", set: setDuration(&c.RequestTimeout)},
+		{env: "SHUTDOWN_TIMEOUT", usage: "how long to drain requests on shutdown", set: setDuration(&c.ShutdownTimeout)},
+		{env: "LOG_LEVEL", flag: "log-level", usage: "debug, info, warn or error", set: setString(&c.LogLevel)},
+		{env: "OTEL_TRACES_EXPORTER", usage: "otlp, stdout or none", set: setString(&c.TracesExporter)},
+		{env: "GATEWAY_TLS_CERT_FILE", usage: "HTTPS certificate", set: setString(&c.TLS.CertFile)},
+		{env: "GATEWAY_TLS_KEY_FILE", usage: "HTTPS private key", set: setString(&c.TLS.KeyFile)},
+		{env: "GATEWAY_TLS_CLIENT_CA_FILE", usage: "CA required of HTTPS clients", set: setString(&c.TLS.ClientCAFile)},
+		{env: "GATEWAY_NODE_TLS_CA_FILE", usage: "CA that signed the node certificates", set: setString(&c.NodeTLS.CAFile)},
+		{env: "GATEWAY_NODE_TLS_CERT_FILE", usage: "client certificate presented to nodes", set: setString(&c.NodeTLS.CertFile)},
+		{env: "GATEWAY_NODE_TLS_KEY_FILE", usage: "client key presented to nodes", set: setString(&c.NodeTLS.KeyFile)},
+		{env: "GATEWAY_NODE_TLS_SERVER_NAME", usage: "name expected in node certificates", set: setString(&c.NodeTLS.ServerName)},
+		{env: "SHARDO_API_KEYS", usage: "API keys as key=principal,...", set: c.setAPIKeys},
+		{env: "SHARDO_HMAC_SECRET", usage: "secret of HMAC-signed tokens", set: setString(&c.Auth.HMACSecret)},
+		{env: "SHARDO_JWKS_FILE", usage: "JWKS with the keys of accepted JWTs", set: setString(&c.Auth.JWKSFile)},
+		{env: "SHARDO_NODE_SECRET", usage: "secret sent to nodes", set: setString(&c.NodeSecret)},
+		{env: "SHARDO_RATE_LIMIT", usage: "requests per second allowed to each client, 0 disables", set: setFloat(&c.RateLimit.RequestsPerSecond)},
+		{env: "SHARDO_RATE_BURST", usage: "burst allowed to each client", set: setInt(&c.RateLimit.Burst)},
+		{env: "SHARDO_MAX_CONCURRENCY", usage: "requests in flight before shedding, 0 disables", set: setInt(&c.RateLimit.MaxConcurrency)},
+		{env: "SHARDO_TARGET_LATENCY", usage: "latency the concurrency limit adapts to, 0 keeps it fixed", set: setDuration(&c.RateLimit.TargetLatency)},
+	}
+	if err := load("gateway", args, c, settings); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+// LoadNode is LoadGateway for cache nodes.
+func LoadNode(args []string) (*Node, error) {
+	c := &Node{
+		Port:            "50051",
+		MetricsPort:     "9100",
+		CacheCapacity:   128,
+		ShutdownTimeout: Duration{15 * time.Second},
+		LogLevel:        "info",
+	}
+	settings := []setting{
+		{env: "NODE_ID", flag: "id", usage: "node identity used in metric labels", set: setString(&c.ID)},
+		{env: "NODE_GRPC_PORT", flag: "port", usage: "gRPC listen port", set: setString(&c.Port)},
+		{env: "METRICS_PORT", flag: "metrics-port", usage: "Prometheus metrics port", set: setString(&c.MetricsPort)},
+		{env: "CACHE_SIZE_MB", flag: "cache-capacity", usage: "maximum number of cached entries", set: setInt(&c.CacheCapacity)},
+		{env: "SHUTDOWN_TIMEOUT", usage: "how long to drain RPCs on shutdown", set: setDuration(&c.ShutdownTimeout)},
+		{env: "LOG_LEVEL", flag: "log-level", usage: "debug, info, warn or error", set: setString(&c.LogLevel)},
+		{env: "OTEL_TRACES_EXPORTER", usage: "otlp, stdout or none", set: setString(&c.TracesExporter)},
+		{env: "NODE_TLS_CERT_FILE", usage: "gRPC certificate", set: setString(&c.TLS.CertFile)},
+		{env: "NODE_TLS_KEY_FILE", usage: "gRPC private key", set: setString(&c.TLS.KeyFile)},
+		{env: "NODE_TLS_CLIENT_CA_FILE", usage: "CA required of gRPC clients", set: setString(&c.TLS.ClientCAFile)},
+		{env: "SHARDO_NODE_SECRET", usage: "secret required of gRPC clients", set: setString(&c.Secret)},
+		{env: "NODE_ALLOWED_CLIENTS", usage: "client certificate names allowed to connect", set: setList(&c.AllowedClients)},
+	}
+	if err := load("node", args, c, settings); err != nil {
+		return nil, err
+	}
+	if c.ID == "" {
+		c.ID, _ = os.Hostname()
+	}
+	return c, c.Validate()
+}
+
+func load(name string, args []string, c any, settings []setting) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("SHARDO_CONFIG"), "YAML or TOML config file")
+	flagged := make(map[string]string)
+	for _, s := range settings {
+		if s.flag == "" {
+			continue
+		}
+		name := s.flag
+		fs.Func(name, s.usage+" (env "+s.env+")", func(v string) error {
+			flagged[name] = v
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path != "" {
+		if err := decodeFile(*path, c); err != nil {
+			return err
+		}
+	}
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(v); err != nil {
+				return fmt.Errorf("config: invalid %s %q: %w", s.env, v, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if v, ok := flagged[s.flag]; ok {
+			if err := s.set(v); err != nil {
+				return fmt.Errorf("config: invalid -%s %q: %w", s.flag, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeFile reads YAML or TOML, picked by extension, rejecting unknown keys.
+func decodeFile(path string, c any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config: %s: unknown field %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported format %q, use .yaml or .toml", path, ext)
+	}
+	return nil
+}
+
+// setNodes parses the NODES list. Only the first colon splits the name off,
+// so addresses keep their own host:port form.
+func (c *Gateway) setNodes(v string) error {
+	var nodes []Member
+	for _, spec := range strings.Split(v, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("node %q is not name:host:port", spec)
+		}
+		nodes = append(nodes, Member{Name: name, Addr: addr})
+	}
+	c.Nodes = nodes
+	return nil
+}
+
+func (c *Gateway) setLabels(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, pairs, ok := strings.Cut(spec, ":")
+		if !ok {
+			return fmt.Errorf("labels %q are not name:key=value;...", spec)
+		}
+		m := c.member(name)
+		if m == nil {
+			return fmt.Errorf("labels for unknown node %q", name)
+		}
+		for _, pair := range strings.Split(pairs, ";") {
+			k, val, _ := strings.Cut(pair, "=")
+			switch k {
+			case "zone":
+				m.Zone = val
+			case "rack":
+				m.Rack = val
+			case "host":
+				m.Host = val
+			default:
+				return fmt.Errorf("unknown label %q for node %q", k, name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Gateway) setAPIKeys(v string) error {
+	var keys []APIKey
+	for _, spec := range strings.Split(v, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		key, principal, ok := strings.Cut(spec, "=")
+		if !ok {
+			return errors.New("API keys are not key=principal,...")
+		}
+		keys = append(keys, APIKey{Key: key, Principal: principal})
+	}
+	c.Auth.APIKeys = keys
+	return nil
+}
+
+func (c *Gateway) member(name string) *Member {
+	for i := range c.Nodes {
+		if c.Nodes[i].Name == name {
+			return &c.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid field at once.
+func (c *Gateway) Validate() error {
+	var errs []error
+	errs = append(errs, checkPort("port", c.Port))
+	if len(c.Nodes) == 0 {
+		errs = append(errs, errors.New("nodes: at least one node is required"))
+	}
+	seen := make(map[string]bool)
+	for i, n := range c.Nodes {
+		field := fmt.Sprintf("nodes[%d]", i)
+		switch {
+		case n.Name == "":
+			errs = append(errs, fmt.Errorf("%s.name: must not be empty", field))
+		case seen[n.Name]:
+			errs = append(errs, fmt.Errorf("%s.name: duplicate node %q", field, n.Name))
+		}
+		seen[n.Name] = true
+		if _, port, err := net.SplitHostPort(n.Addr); err != nil {
+			errs = append(errs, fmt.Errorf("%s.addr: %q is not host:port", field, n.Addr))
+		} else {
+			errs = append(errs, checkPort(field+".addr", port))
+		}
+		if n.Weight < 0 {
+			errs = append(errs, fmt.Errorf("%s.weight: must not be negative, got %d", field, n.Weight))
+		}
+	}
+	if c.VirtualReplicas < 1 {
+		errs = append(errs, fmt.Errorf("virtual_replicas: must be at least 1, got %d", c.VirtualReplicas))
+	}
+	if c.ReplicationFactor < 1 {
+		errs = append(errs, fmt.Errorf("replication_factor: must be at least 1, got %d", c.ReplicationFactor))
+	}
+	if c.LoadEpsilon < 0 {
+		errs = append(errs, fmt.Errorf("load_epsilon: must not be negative, got %v", c.LoadEpsilon))
+	}
+	if c.LoadEpsilon > 0 && c.ReplicationFactor == 1 {
+		// Reads only spill to other replicas of a key; with one copy there
+		// is nowhere to send them.
+		errs = append(errs, errors.New("load_epsilon: needs replication_factor of at least 2"))
+	}
+	if _, ok := hashring.HashFuncByName(c.HashFunc); !ok {
+		errs = append(errs, fmt.Errorf("hash_func: unknown hash function %q", c.HashFunc))
+	}
+	errs = append(errs,
+		checkPositive("request_timeout", c.RequestTimeout),
+		checkPositive("shutdown_timeout", c.ShutdownTimeout),
+		checkLevel(c.LogLevel),
+		checkExporter(c.TracesExporter),
+	)
+	errs = append(errs, c.TLS.check("tls")...)
+	errs = append(errs, c.NodeTLS.check("node_tls")...)
+	errs = append(errs, c.Auth.check()...)
+	errs = append(errs, c.RateLimit.check()...)
+	return joinErrors(errs)
+}
+
+func (c *Node) Validate() error {
+	var errs []error
+	errs = append(errs, checkPort("port", c.Port), checkPort("metrics_port", c.MetricsPort))
+	if c.CacheCapacity < 1 {
+		errs = append(errs, fmt.Errorf("cache_capacity: must be at least 1, got %d", c.CacheCapacity))
+	}
+	errs = append(errs,
+		checkPositive("shutdown_timeout", c.ShutdownTimeout),
+		checkLevel(c.LogLevel),
+		checkExporter(c.TracesExporter),
+	)
+	errs = append(errs, c.TLS.check("tls")...)
+	if len(c.AllowedClients) > 0 && c.TLS.ClientCAFile == "" {
+		errs = append(errs, errors.New("allowed_clients: needs tls.client_ca_file to verify client certificates"))
+	}
+	seen := make(map[string]bool)
+	for i, q := range c.Namespaces {
+		field := fmt.Sprintf("namespaces[%d]", i)
+		if !cache.ValidNamespace(q.Name) {
+			errs = append(errs, fmt.Errorf("%s.name: %q must be 1 to 64 letters, digits, '-', '_' or '.'", field, q.Name))
+		}
+		if seen[q.Name] {
+			errs = append(errs, fmt.Errorf("%s.name: duplicate namespace %q", field, q.Name))
+		}
+		seen[q.Name] = true
+		if q.MaxKeys < 0 || q.MaxBytes < 0 {
+			errs = append(errs, fmt.Errorf("%s: max_keys and max_bytes must not be negative", field))
+		}
+	}
+	return joinErrors(errs)
+}
+
+func (t ServerTLS) check(field string) []error {
+	var errs []error
+	if t.Enabled() && (t.CertFile == "" || t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s: cert_file and key_file must be set together", field))
+	}
+	if t.ClientCAFile != "" && !t.Enabled() {
+		errs = append(errs, fmt.Errorf("%s.client_ca_file: needs cert_file and key_file", field))
+	}
+	return append(errs,
+		checkFile(field+".cert_file", t.CertFile),
+		checkFile(field+".key_file", t.KeyFile),
+		checkFile(field+".client_ca_file", t.ClientCAFile),
+	)
+}
+
+func (t ClientTLS) check(field string) []error {
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("%s: cert_file and key_file must be set together", field))
+	}
+	return append(errs,
+		checkFile(field+".ca_file", t.CAFile),
+		checkFile(field+".cert_file", t.CertFile),
+		checkFile(field+".key_file", t.KeyFile),
+	)
+}
+
+func (l RateLimit) check() []error {
+	var errs []error
+	if l.RequestsPerSecond < 0 || l.Burst < 0 || l.MaxConcurrency < 0 || l.MinConcurrency < 0 || l.TargetLatency.Duration < 0 {
+		errs = append(errs, errors.New("rate_limit: values must not be negative"))
+	}
+	if l.Burst > 0 && l.RequestsPerSecond == 0 {
+		errs = append(errs, errors.New("rate_limit.burst: needs requests_per_second"))
+	}
+	if (l.MinConcurrency > 0 || l.TargetLatency.Duration > 0) && l.MaxConcurrency == 0 {
+		errs = append(errs, errors.New("rate_limit: min_concurrency and target_latency need max_concurrency"))
+	}
+	if l.MinConcurrency > l.MaxConcurrency && l.MaxConcurrency > 0 {
+		errs = append(errs, fmt.Errorf("rate_limit.min_concurrency: must not exceed max_concurrency, got %d > %d",
+			l.MinConcurrency, l.MaxConcurrency))
+	}
+	return errs
+}
+
+func (a Auth) check() []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, k := range a.APIKeys {
+		field := fmt.Sprintf("auth.api_keys[%d]", i)
+		if k.Key == "" || k.Principal == "" {
+			errs = append(errs, fmt.Errorf("%s: key and principal must not be empty", field))
+		}
+		if seen[k.Key] {
+			errs = append(errs, fmt.Errorf("%s: duplicate key", field))
+		}
+		seen[k.Key] = true
+	}
+	errs = append(errs, checkFile("auth.jwks_file", a.JWKSFile))
+	if a.Enabled() && len(a.Policy) == 0 {
+		errs = append(errs, errors.New("auth.policy: at least one rule is required when auth is enabled"))
+	}
+	for i, rule := range a.Policy {
+		field := fmt.Sprintf("auth.policy[%d]", i)
+		if rule.Principal == "" {
+			errs = append(errs, fmt.Errorf("%s.principal: must not be empty, use \"*\" for anyone", field))
+		}
+		if len(rule.Operations) == 0 {
+			errs = append(errs, fmt.Errorf("%s.operations: must not be empty", field))
+		}
+		keyed := false
+		for _, op := range rule.Operations {
+			switch op {
+			case "read", "write":
+				keyed = true
+			case "admin":
+			default:
+				errs = append(errs, fmt.Errorf("%s.operations: unknown operation %q", field, op))
+			}
+		}
+		if keyed && len(rule.Prefixes) == 0 {
+			errs = append(errs, fmt.Errorf("%s.prefixes: required for read and write, use \"\" for every key", field))
+		}
+		for _, ns := range rule.Namespaces {
+			if !cache.ValidNamespace(ns) {
+				errs = append(errs, fmt.Errorf("%s.namespaces: invalid namespace %q", field, ns))
+			}
+		}
+	}
+	return errs
+}
+
+func joinErrors(errs []error) error {
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("config: invalid settings:\n%w", err)
+	}
+	return nil
+}
+
+func checkPort(field, port string) error {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%s: %q is not a port number", field, port)
+	}
+	return nil
+}
+
+func checkPositive(field string, d Duration) error {
+	if d.Duration <= 0 {
+		return fmt.Errorf("%s: must be positive, got %s", field, d)
+	}
+	return nil
+}
+
+func checkFile(field, path string) error {
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	return nil
+}
+
+func checkLevel(level string) error {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "error":
+		return nil
+	}
+	return fmt.Errorf("log_level: unknown level %q", level)
+}
+
+func checkExporter(exporter string) error {
+	switch exporter {
+	case "", "none", "otlp", "stdout", "console":
+		return nil
+	}
+	return fmt.Errorf("traces_exporter: unknown exporter %q", exporter)
+}
+
+func setString(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func setList(p *[]string) func(string) error {
+	return func(v string) error {
+		var list []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		*p = list
+		return nil
+	}
+}
+
+func setInt(p *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		*p = n
+		return nil
+	}
+}
+
+func setFloat(p *float64) func(string) error {
+	return func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return errors.New("not a number")
+		}
+		*p = f
+		return nil
+	}
+}
+
+func setDuration(p *Duration) func(string) error {
+	return func(v string) error {
+		return p.UnmarshalText([]byte(v))
+	}
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadGatewayYAML(t *testing.T) {
+	path := writeFile(t, "gateway.yaml", `
+port: "9000"
+zone: a
+replication_factor: 3
+request_timeout: 500ms
+nodes:
+  - {name: n1, addr: "10.0.0.1:50051", zone: a, weight: 2}
+  - {name: n2, addr: "[::1]:50052", zone: b}
+`)
+	cfg, err := LoadGateway([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "9000" || cfg.ReplicationFactor != 3 || cfg.RequestTimeout.Duration != 500*time.Millisecond {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Nodes) != 2 || cfg.Nodes[0].Weight != 2 || cfg.Nodes[1].Addr != "[::1]:50052" {
+		t.Fatalf("unexpected nodes %+v", cfg.Nodes)
+	}
+	if cfg.VirtualReplicas != 100 || cfg.HashFunc != "sha256" {
+		t.Fatalf("expected defaults to fill unset fields, got %+v", cfg)
+	}
+}
+
+func TestLoadNodeTOML(t *testing.T) {
+	path := writeFile(t, "node.toml", `
+id = "node7"
+port = "50057"
+cache_capacity = 5000
+shutdown_timeout = "30s"
+strict_namespaces = true
+
+[[namespaces]]
+name = "team-a"
+max_keys = 1000
+`)
+	t.Setenv("SHARDO_CONFIG", path)
+	cfg, err := LoadNode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ID != "node7" || cfg.Port != "50057" || cfg.CacheCapacity != 5000 || cfg.ShutdownTimeout.Duration != 30*time.Second ||
+		!cfg.StrictNamespaces {
+		t.Fatalf("unexpected config %+v", cfg)
+	}
+	if len(cfg.Namespaces) != 1 || cfg.Namespaces[0] != (Quota{Name: "team-a", MaxKeys: 1000}) {
+		t.Fatalf("unexpected namespaces %+v", cfg.Namespaces)
+	}
+
+	bad := writeFile(t, "bad.toml", "[[namespaces]]\nname = \"a b\"\n[[namespaces]]\nname = \"x\"\nmax_bytes = -1\n")
+	if _, err := LoadNode([]string{"-config", bad}); err == nil ||
+		!strings.Contains(err.Error(), "namespaces[0].name") || !strings.Contains(err.Error(), "namespaces[1]: max_keys") {
+		t.Fatalf("expected namespace errors, got %v", err)
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	path := writeFile(t, "gateway.yaml", `
+port: "9000"
+log_level: warn
+nodes: [{name: n1, addr: "h1:1"}]
+`)
+	t.Setenv("GATEWAY_HTTP_PORT", "9100")
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("NODES", "n1:h1:50051,n2:h2:50052")
+	t.Setenv("NODE_LABELS", "n2:zone=b;rack=r2")
+	cfg, err := LoadGateway([]string{"-config", path, "-log-level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "9100" {
+		t.Fatalf("expected env to override the file, got port %s", cfg.Port)
+	}
+	if cfg.LogLevel != "error" {
+		t.Fatalf("expected the flag to override env, got level %s", cfg.LogLevel)
+	}
+	if len(cfg.Nodes) != 2 || cfg.Nodes[1].Addr != "h2:50052" || cfg.Nodes[1].Zone != "b" || cfg.Nodes[1].Rack != "r2" {
+		t.Fatalf("unexpected nodes %+v", cfg.Nodes)
+	}
+}
+
+func TestLoadRejectsBadInput(t *testing.T) {
+	cases := map[string]struct {
+		file string
+		env  map[string]string
+		want []string
+	}{
+		"unknown key": {
+			file: "nodez: []\n",
+			want: []string{"nodez"},
+		},
+		"bad env value": {
+			env:  map[string]string{"NODES": "n1:h:1", "SHARDO_REPLICATION_FACTOR": "two"},
+			want: []string{"SHARDO_REPLICATION_FACTOR", "not an integer"},
+		},
+		"labels for unknown node": {
+			env:  map[string]string{"NODES": "n1:h:1", "NODE_LABELS": "n9:zone=a"},
+			want: []string{"unknown node", "n9"},
+		},
+		"incomplete tls": {
+			file: "nodes: [{name: n1, addr: 'h1:1'}]\ntls: {cert_file: missing.pem}\nnode_tls: {key_file: key.pem}\n",
+			want: []string{"tls: cert_file and key_file must be set together", "tls.cert_file: stat missing.pem", "node_tls: cert_file and key_file"},
+		},
+		"auth without policy": {
+			env:  map[string]string{"NODES": "n1:h:1", "SHARDO_API_KEYS": "k1=team-a,k1=team-b"},
+			want: []string{"auth.api_keys[1]: duplicate key", "auth.policy: at least one rule"},
+		},
+		"bad policy rule": {
+			file: "nodes: [{name: n1, addr: 'h1:1'}]\nauth: {hmac_secret: s, policy: [{principal: team-a, namespaces: [ok, 'not ok'], operations: [read, flush]}]}\n",
+			want: []string{"auth.policy[0].operations: unknown operation \"flush\"", "auth.policy[0].prefixes: required",
+				"auth.policy[0].namespaces: invalid namespace \"not ok\""},
+		},
+		"bad rate limit": {
+			file: "nodes: [{name: n1, addr: 'h1:1'}]\nrate_limit: {burst: 5, min_concurrency: 10, target_latency: 50ms}\n",
+			want: []string{"rate_limit.burst: needs requests_per_second", "need max_concurrency"},
+		},
+		"bounded load without replicas": {
+			file: "nodes: [{name: n1, addr: 'h1:1'}]\nreplication_factor: 1\nload_epsilon: 0.25\n",
+			want: []string{"load_epsilon: needs replication_factor"},
+		},
+		"every invalid field": {
+			file: "port: http\nreplication_factor: 0\nhash_func: md5\nnodes: [{name: n1, addr: h1}, {name: n1, addr: 'h2:99999'}]\n",
+			want: []string{"port:", "replication_factor:", "hash_func:", "nodes[0].addr", "nodes[1].name", "nodes[1].addr"},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var args []string
+			if tc.file != "" {
+				args = []string{"-config", writeFile(t, "gateway.yaml", tc.file)}
+			}
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			_, err := LoadGateway(args)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("expected %q in error:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
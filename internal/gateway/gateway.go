@@ -3,87 +3,635 @@ package gateway
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"shardo/internal/auth"
+	"shardo/internal/logging"
+	"shardo/internal/ratelimit"
+	"shardo/internal/tlsutil"
+	"shardo/internal/tracing"
+	"shardo/pkg/cache"
 	"shardo/pkg/hashring"
 	"shardo/proto/cachepb"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type Gateway struct {
-	ring     *hashring.HashRing
-	nodes    map[string]string // nodeName -> address
-	replicas int
+	ring            *hashring.HashRing
+	sharedRing      bool // ring came from GatewayConfig.Ring; Reload leaves it alone
+	replicas        int
+	zone            string
+	shutdownTimeout time.Duration
+	tls             *tlsutil.Reloader
+	nodeTLS         *tlsutil.Reloader
+	nodeServerName  string
+	nodeSecret      string
+
+	// Guarded by mu since Reload may change them while serving.
+	mu                sync.RWMutex
+	nodes             map[string]string // nodeName -> address
+	replicationFactor int
+	requestTimeout    time.Duration
+	guard             *auth.Guard
+	limiter           *ratelimit.Limiter
+	shedder           *ratelimit.Shedder
+	trustProxy        bool
+
+	metrics *gatewayMetrics
+
+	// shutdown is closed when Serve starts draining, to end /watch streams
+	// while other requests finish.
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
 type GatewayConfig struct {
-	Nodes    map[string]string // nodeName -> address
-	Replicas int
+	Nodes             map[string]string // nodeName -> address
+	NodeLabels        map[string]hashring.Labels
+	NodeWeights       map[string]int // missing or 0 means weight 1
+	Zone              string         // zone the gateway runs in, preferred for reads
+	Replicas          int            // virtual nodes per node on the ring
+	ReplicationFactor int            // copies kept of each key, 1 disables replication
+	LoadEpsilon       float64        // 0 disables bounded-load routing
+	HashFunc          hashring.HashFunc
+	Ring              *hashring.HashRing // shared ring; overrides the ring settings above
+	Registry          prometheus.Registerer
+	ShutdownTimeout   time.Duration      // how long Serve drains requests, default 15s
+	RequestTimeout    time.Duration      // timeout of each call to a node, default 2s
+	TLS               *tlsutil.Reloader  // serves HTTPS when set
+	NodeTLS           *tlsutil.Reloader  // dials nodes over TLS when set
+	NodeServerName    string             // overrides the name expected in node certificates
+	NodeSecret        string             // sent to nodes with every call when set
+	Auth              *auth.Guard        // nil leaves the gateway open
+	RateLimit         *ratelimit.Limiter // per-client token buckets, nil disables
+	Shedder           *ratelimit.Shedder // caps requests in flight, nil disables
+	TrustProxy        bool               // identify clients by X-Forwarded-For
 }
 
 func NewGateway(cfg GatewayConfig) *Gateway {
-	ring := hashring.New(cfg.Replicas)
+	ring := cfg.Ring
+	if ring == nil {
+		opts := []hashring.Option{hashring.WithLoadBound(cfg.LoadEpsilon)}
+		if cfg.HashFunc != nil {
+			opts = append(opts, hashring.WithHashFunc(cfg.HashFunc))
+		}
+		ring = hashring.New(cfg.Replicas, opts...)
+		for n := range cfg.Nodes {
+			ring.AddNodeWithWeight(n, nodeWeight(cfg, n), cfg.NodeLabels[n])
+		}
+	}
+	reg := cfg.Registry
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	shutdownTimeout := cfg.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 15 * time.Second
+	}
+	g := &Gateway{
+		ring:              ring,
+		sharedRing:        cfg.Ring != nil,
+		nodes:             cfg.Nodes,
+		replicas:          cfg.Replicas,
+		replicationFactor: cfg.ReplicationFactor,
+		requestTimeout:    requestTimeout(cfg),
+		zone:              cfg.Zone,
+		shutdownTimeout:   shutdownTimeout,
+		tls:               cfg.TLS,
+		nodeTLS:           cfg.NodeTLS,
+		nodeServerName:    cfg.NodeServerName,
+		nodeSecret:        cfg.NodeSecret,
+		guard:             cfg.Auth,
+		limiter:           cfg.RateLimit,
+		shedder:           cfg.Shedder,
+		trustProxy:        cfg.TrustProxy,
+		metrics:           newGatewayMetrics(reg),
+		shutdown:          make(chan struct{}),
+	}
+	g.updateRingMetrics()
+	return g
+}
+
+// Reload applies the settings that can change without a restart: the node
+// list with labels and weights, the replication factor, the request timeout,
+// auth and the rate and concurrency limits. Other fields of cfg are ignored.
+//
+// A gateway built on a shared ring (GatewayConfig.Ring) keeps that ring as
+// it is, so it goes on placing keys like the other gateways loading the
+// same ring file: only node addresses are taken from cfg, and a reload
+// leaving a ring node without one is rejected.
+func (g *Gateway) Reload(cfg GatewayConfig) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.sharedRing {
+		for _, n := range g.ring.Nodes() {
+			if _, ok := cfg.Nodes[n]; !ok {
+				return fmt.Errorf("gateway: ring node %s has no address in the node list", n)
+			}
+		}
+	} else {
+		g.updateMembership(cfg)
+	}
+	g.nodes = cfg.Nodes
+	g.replicationFactor = cfg.ReplicationFactor
+	g.requestTimeout = requestTimeout(cfg)
+	g.guard = cfg.Auth
+	g.limiter = cfg.RateLimit
+	g.shedder = cfg.Shedder
+	g.trustProxy = cfg.TrustProxy
+	g.updateRingMetrics()
+	return nil
+}
+
+// updateMembership adds, removes, relabels and reweighs ring nodes to match
+// cfg. It must be called with mu held.
+func (g *Gateway) updateMembership(cfg GatewayConfig) {
+	for n := range g.nodes {
+		if _, ok := cfg.Nodes[n]; !ok {
+			g.ring.RemoveNode(n)
+		}
+	}
 	for n := range cfg.Nodes {
-		ring.AddNode(n)
+		weight, labels := nodeWeight(cfg, n), cfg.NodeLabels[n]
+		switch _, ok := g.nodes[n]; {
+		case !ok:
+			g.ring.AddNodeWithWeight(n, weight, labels)
+		case g.ring.Labels(n) != labels:
+			g.ring.RemoveNode(n)
+			g.ring.AddNodeWithWeight(n, weight, labels)
+		case g.ring.Weight(n) != weight:
+			g.ring.SetWeight(n, weight)
+		}
 	}
-	return &Gateway{
-		ring:     ring,
-		nodes:    cfg.Nodes,
-		replicas: cfg.Replicas,
+}
+
+func nodeWeight(cfg GatewayConfig, node string) int {
+	if w := cfg.NodeWeights[node]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+func requestTimeout(cfg GatewayConfig) time.Duration {
+	if cfg.RequestTimeout > 0 {
+		return cfg.RequestTimeout
 	}
+	return 2 * time.Second
 }
 
-func (g *Gateway) Serve(port string) {
-	http.HandleFunc("/get", g.handleGet)
-	http.HandleFunc("/set", g.handleSet)
-	http.HandleFunc("/delete", g.handleDelete)
-	http.HandleFunc("/benchmark", g.handleBenchmark)
-	log.Printf("Gateway listening on %s", port)
+func (g *Gateway) addr(node string) string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.nodes[node]
+}
+
+// nodeAddrs returns a copy of the node list.
+func (g *Gateway) nodeAddrs() map[string]string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	nodes := make(map[string]string, len(g.nodes))
+	for n, addr := range g.nodes {
+		nodes[n] = addr
+	}
+	return nodes
+}
+
+func (g *Gateway) authGuard() *auth.Guard {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.guard
+}
+
+func (g *Gateway) limits() (*ratelimit.Limiter, *ratelimit.Shedder, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.limiter, g.shedder, g.trustProxy
+}
+
+func (g *Gateway) settings() (replicationFactor int, timeout time.Duration) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.replicationFactor, g.requestTimeout
+}
+
+// Serve runs the gateway on port until ctx is cancelled, then stops taking
+// new connections and waits for in-flight requests up to the shutdown
+// timeout. Open /watch streams are ended right away.
+func (g *Gateway) Serve(ctx context.Context, port string) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return fmt.Errorf("gateway: listening on %s: %w", port, err)
+	}
+	slog.Info("gateway listening", "port", port, "tls", g.tls != nil)
+	return g.serve(ctx, lis)
+}
+
+func (g *Gateway) serve(ctx context.Context, lis net.Listener) error {
 	srv := &http.Server{
-		Addr:         ":" + port,
-		Handler:      nil,
+		Handler:      g.handler(),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
+		ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
 	}
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("gateway server error: %v", err)
+	srv.RegisterOnShutdown(func() { g.shutdownOnce.Do(func() { close(g.shutdown) }) })
+	errc := make(chan error, 1)
+	if g.tls != nil {
+		srv.TLSConfig = g.tls.ServerConfig()
+		go func() { errc <- srv.ServeTLS(lis, "", "") }()
+	} else {
+		go func() { errc <- srv.Serve(lis) }()
 	}
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down gateway", "timeout", g.shutdownTimeout.String())
+	sctx, scancel := context.WithTimeout(context.Background(), g.shutdownTimeout)
+	defer scancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		srv.Close()
+		return fmt.Errorf("gateway: draining connections: %w", err)
+	}
+	return nil
 }
 
-func (g *Gateway) getNodeAddr(key string) string {
-	node := g.ring.GetNode(key)
-	return g.nodes[node]
+func (g *Gateway) handler() http.Handler {
+	mux := http.NewServeMux()
+	// handle wires a route through instrumentation, load shedding, auth and
+	// the per-client rate limit. Streams are not shed: they would hold a
+	// slot for as long as they last. Metrics and spans are labelled with
+	// the pattern's path.
+	handle := func(pattern string, op auth.Operation, key func(*http.Request) string, stream bool, h http.HandlerFunc) {
+		route := pattern[strings.Index(pattern, "/"):]
+		h = g.authorize(route, op, key, g.throttle(route, h))
+		if !stream {
+			h = g.shed(route, h)
+		}
+		mux.HandleFunc(pattern, g.instrument(route, h))
+	}
+	handle("/get", auth.OpRead, query("key"), false, g.handleGet)
+	handle("/set", auth.OpWrite, query("key"), false, g.handleSet)
+	handle("/delete", auth.OpWrite, query("key"), false, g.handleDelete)
+	handle("/benchmark", auth.OpAdmin, nil, false, g.handleBenchmark)
+	handle("/ring", auth.OpAdmin, nil, false, g.handleRing)
+	handle("/nodes", auth.OpAdmin, nil, false, g.handleNodes)
+	handle("/locate", auth.OpRead, query("key"), false, g.handleLocate)
+	handle("/watch", auth.OpRead, query("prefix"), true, g.handleWatch)
+	handle("/flush", auth.OpWrite, nil, false, g.handleFlush)
+	handle("GET "+keysRoute, auth.OpRead, pathKey, false, g.handleKeyGet)
+	handle("PUT "+keysRoute, auth.OpWrite, pathKey, false, g.handleKeyPut)
+	handle("DELETE "+keysRoute, auth.OpWrite, pathKey, false, g.handleKeyDelete)
+	mux.HandleFunc(keysRoute, g.instrument(keysRoute, methodNotAllowed))
+	mux.HandleFunc("GET /v2/openapi.yaml", g.instrument("/v2/openapi.yaml", handleOpenAPI))
+	mux.HandleFunc("/v2/", g.instrument("/v2/", routeNotFound))
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
 }
 
-func (g *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("key")
-	addr := g.getNodeAddr(key)
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+// query returns a func reading the query parameter name, for authorize.
+func query(name string) func(*http.Request) string {
+	return func(r *http.Request) string { return r.URL.Query().Get(name) }
+}
+
+// authorize lets the request through to next if the auth policy allows op
+// on the key read by key, within the namespace parameter. Admin routes
+// pass a nil key and are not namespaced. Failed authentication attempts are
+// rate limited by IP.
+func (g *Gateway) authorize(route string, op auth.Operation, key func(*http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ns := namespace(r)
+		if op != auth.OpAdmin {
+			if !cache.ValidNamespace(ns) {
+				writeError(w, r, http.StatusBadRequest, "invalid_namespace", "invalid namespace")
+				return
+			}
+			trace.SpanFromContext(r.Context()).SetAttributes(tracing.AttrNamespace.String(ns))
+		}
+		guard := g.authGuard()
+		if guard == nil {
+			next(w, r)
+			return
+		}
+		if g.authThrottled(w, r, route) {
+			return
+		}
+		var k string
+		if key != nil {
+			k = key(r)
+		}
+		principal, err := guard.Authorize(r, op, ns, k)
+		switch {
+		case errors.Is(err, auth.ErrForbidden):
+			slog.WarnContext(r.Context(), "request denied", "principal", principal, "op", op, "namespace", ns)
+			writeError(w, r, http.StatusForbidden, "forbidden", "forbidden")
+			return
+		case err != nil:
+			slog.InfoContext(r.Context(), "authentication failed", "err", err)
+			g.authFailed(r)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, http.StatusUnauthorized, "unauthorized", "unauthorized")
+			return
+		}
+		trace.SpanFromContext(r.Context()).SetAttributes(tracing.AttrPrincipal.String(principal))
+		next(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	}
+}
+
+// namespace returns the namespace query parameter, cache.DefaultNamespace
+// when it is missing. Nodes are always sent the name explicitly, so an
+// empty FlushAll namespace never reaches them from here.
+func namespace(r *http.Request) string {
+	if ns := r.URL.Query().Get("namespace"); ns != "" {
+		return ns
+	}
+	return cache.DefaultNamespace
+}
+
+// route returns the nodes holding key, in the order to try them, and a func
+// releasing the load counted against them. Writes go to every replica, in
+// ring order so the key's owner comes first on every gateway, and count load
+// on each. Reads count it on the replica asked first, which with bounded
+// loads is the first one under the bound: reads only spill to nodes holding
+// the key and writes never spill, so both agree on where keys live.
+func (g *Gateway) route(key string, read bool) ([]string, func()) {
+	var nodes, acquired []string
+	if read {
+		nodes = g.ring.AcquireAmong(g.replicaNodes(key))
+		acquired = nodes[:min(1, len(nodes))]
+	} else {
+		rf, _ := g.settings()
+		nodes = g.ring.GetReplicas(key, max(rf, 1))
+		acquired = nodes
+		for _, n := range nodes {
+			g.ring.AcquireNode(n)
+		}
+	}
+	g.metrics.loadSkew.Set(g.ring.LoadSkew())
+	return nodes, func() {
+		for _, n := range acquired {
+			g.ring.Release(n)
+		}
+		g.metrics.loadSkew.Set(g.ring.LoadSkew())
+	}
+}
+
+func (g *Gateway) replicaNodes(key string) []string {
+	rf, _ := g.settings()
+	return g.preferLocal(g.ring.GetReplicas(key, max(rf, 1)))
+}
+
+// preferLocal moves replicas in the gateway's own zone to the front, keeping
+// ring order otherwise.
+func (g *Gateway) preferLocal(nodes []string) []string {
+	if g.zone == "" {
+		return nodes
+	}
+	local := make([]string, 0, len(nodes))
+	var remote []string
+	for _, n := range nodes {
+		if g.ring.Labels(n).Zone == g.zone {
+			local = append(local, n)
+		} else {
+			remote = append(remote, n)
+		}
+	}
+	return append(local, remote...)
+}
+
+// dial connects to a node, over TLS when configured. A TLS config is built
+// per dial so rotated CA files are picked up by later requests.
+func (g *Gateway) dial(addr string) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if g.nodeTLS != nil {
+		creds = credentials.NewTLS(g.nodeTLS.ClientConfig(g.nodeServerName))
+	}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		grpc.WithChainUnaryInterceptor(logging.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(logging.StreamClientInterceptor()),
+	}
+	if g.nodeSecret != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(auth.NodeSecret(g.nodeSecret)))
+	}
+	return grpc.Dial(addr, opts...)
+}
+
+func (g *Gateway) withNode(ctx context.Context, node, op string, fn func(context.Context, cachepb.CacheServiceClient) error) (err error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "node."+op, trace.WithAttributes(tracing.AttrNode.String(node)))
+	defer func() {
+		g.metrics.observeNode(node, op, start, err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(otelcodes.Error, status.Code(err).String())
+		}
+		span.End()
+	}()
+	conn, err := g.dial(g.addr(node))
 	if err != nil {
-		http.Error(w, "node unavailable", 500)
-		return
+		return status.Error(codes.Unavailable, err.Error())
 	}
 	defer func() {
 		if err := conn.Close(); err != nil {
-			log.Printf("error closing gRPC connection: %v", err)
+			slog.WarnContext(ctx, "error closing gRPC connection", "node", node, "err", err)
 		}
 	}()
-	client := cachepb.NewCacheServiceClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	_, timeout := g.settings()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	resp, err := client.Get(ctx, &cachepb.GetRequest{Key: key})
+	return fn(ctx, cachepb.NewCacheServiceClient(conn))
+}
+
+// errNoNodes is returned by the node helpers below when the ring is empty.
+var errNoNodes = status.Error(codes.Unavailable, "no nodes on the ring")
+
+// fetch reads key from its replicas in preference order, moving on to the
+// next one when a node fails or misses the key, since a replica may have
+// missed a write the others took. A miss is returned once every replica
+// that answered missed; the error is the last node's when none answered.
+func (g *Gateway) fetch(ctx context.Context, ns, key string) (*cachepb.GetResponse, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(tracing.KeyHash(key))
+	nodes, release := g.route(key, true)
+	defer release()
+	var miss *cachepb.GetResponse
+	err := errNoNodes
+	for _, node := range nodes {
+		var resp *cachepb.GetResponse
+		err = g.withNode(ctx, node, "get", func(ctx context.Context, client cachepb.CacheServiceClient) error {
+			var err error
+			resp, err = client.Get(ctx, &cachepb.GetRequest{Key: key, Namespace: ns})
+			return err
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "get failed", tracing.LogKeyHash(key), "node", node, "err", err)
+			continue
+		}
+		span.SetAttributes(tracing.AttrNode.String(node), tracing.AttrHit.Bool(resp.Found))
+		if !resp.Found {
+			miss = resp
+			continue
+		}
+		span.SetAttributes(tracing.AttrValueSize.Int(len(resp.Value)))
+		return resp, nil
+	}
+	if miss != nil {
+		return miss, nil
+	}
+	return nil, err
+}
+
+// store writes req to every replica of its key; see replicate for how
+// failures are reported and how req.IfMatch is checked.
+func (g *Gateway) store(ctx context.Context, req *cachepb.SetRequest) (*cachepb.SetResponse, error) {
+	trace.SpanFromContext(ctx).SetAttributes(tracing.KeyHash(req.Key), tracing.AttrValueSize.Int(len(req.Value)))
+	nodes, release := g.route(req.Key, false)
+	defer release()
+	var resp *cachepb.SetResponse
+	err := g.replicate(ctx, "set", req.Key, nodes, req.IfMatch != nil, func(ctx context.Context, client cachepb.CacheServiceClient, check bool) error {
+		msg := &cachepb.SetRequest{Key: req.Key, Value: req.Value, Ttl: req.Ttl, Namespace: req.Namespace, ContentType: req.ContentType}
+		if check {
+			msg.IfMatch = req.IfMatch
+		}
+		r, err := client.Set(ctx, msg)
+		if err == nil {
+			resp = r
+		}
+		return err
+	})
+	var partial *partialWriteError
+	if err != nil && !errors.As(err, &partial) {
+		return nil, err
+	}
+	return resp, err
+}
+
+// remove deletes key from every replica. ifMatch and failures work as in
+// store.
+func (g *Gateway) remove(ctx context.Context, ns, key string, ifMatch []string) error {
+	trace.SpanFromContext(ctx).SetAttributes(tracing.KeyHash(key))
+	nodes, release := g.route(key, false)
+	defer release()
+	return g.replicate(ctx, "delete", key, nodes, ifMatch != nil, func(ctx context.Context, client cachepb.CacheServiceClient, check bool) error {
+		req := &cachepb.DeleteRequest{Key: key, Namespace: ns}
+		if check {
+			req.IfMatch = ifMatch
+		}
+		_, err := client.Delete(ctx, req)
+		return err
+	})
+}
+
+// partialWriteError is returned when some replicas took a write and others
+// failed. Until the key is written again or expires, the failed replicas
+// keep their old copy.
+type partialWriteError struct {
+	failed []string
+	err    error // the last failure
+}
+
+func (e *partialWriteError) Error() string {
+	return fmt.Sprintf("write failed on %s: %v", strings.Join(e.failed, ", "), e.err)
+}
+
+func (e *partialWriteError) Unwrap() error { return e.err }
+
+// replicate runs write against every node, carrying on past failures so
+// that as many replicas as possible take it. It returns the last error when
+// no node took the write and a *partialWriteError when only some did.
+//
+// A conditional write is checked on the first node, the key's owner, alone:
+// writes to a key are serialized there, and the other replicas only get the
+// write, unconditionally, once the owner took it. A refused condition or an
+// owner that cannot be reached leaves every replica untouched, instead of
+// splitting them when their copies have diverged.
+func (g *Gateway) replicate(ctx context.Context, op, key string, nodes []string, conditional bool,
+	write func(ctx context.Context, client cachepb.CacheServiceClient, check bool) error) error {
+	if len(nodes) == 0 {
+		return errNoNodes
+	}
+	var failed []string
+	var last error
+	for i, node := range nodes {
+		check := conditional && i == 0
+		err := g.withNode(ctx, node, op, func(ctx context.Context, client cachepb.CacheServiceClient) error {
+			return write(ctx, client, check)
+		})
+		if check && err != nil {
+			if status.Code(err) != codes.FailedPrecondition {
+				slog.ErrorContext(ctx, op+" failed", tracing.LogKeyHash(key), "node", node, "err", err)
+			}
+			return err
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, op+" failed", tracing.LogKeyHash(key), "node", node, "err", err)
+			failed = append(failed, node)
+			last = err
+		}
+	}
+	switch len(failed) {
+	case 0:
+		return nil
+	case len(nodes):
+		return last
+	}
+	g.metrics.partialWrites.WithLabelValues(op).Inc()
+	slog.WarnContext(ctx, "replicas diverged after a partial write", "op", op, tracing.LogKeyHash(key), "failed", failed)
+	return &partialWriteError{failed: failed, err: last}
+}
+
+// failedReplicasHeader lists the replicas that missed a write, comma
+// separated, on responses to writes other replicas took, and the nodes a
+// /flush could not reach.
+const failedReplicasHeader = "X-Shardo-Failed-Replicas"
+
+// reportPartial tells the client which replicas missed a write that others
+// took, and returns nil for such a write since it did happen. Other errors
+// are returned as they are.
+func reportPartial(w http.ResponseWriter, err error) error {
+	var partial *partialWriteError
+	if !errors.As(err, &partial) {
+		return err
+	}
+	w.Header().Set(failedReplicasHeader, strings.Join(partial.failed, ","))
+	return nil
+}
+
+// handleGet answers 404 for node failures as well as missing keys; v1
+// clients rely on it, /v2/keys tells them apart.
+func (g *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	resp, err := g.fetch(r.Context(), namespace(r), key)
 	if err != nil || !resp.Found {
 		http.Error(w, "not found", 404)
 		return
 	}
 	if _, err := w.Write(resp.Value); err != nil {
-		log.Printf("error writing response: %v", err)
+		slog.WarnContext(r.Context(), "error writing response", tracing.LogKeyHash(key), "err", err)
 	}
 }
 
@@ -95,22 +643,14 @@ func (g *Gateway) handleSet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid body", 400)
 		return
 	}
-	addr := g.getNodeAddr(key)
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
-	if err != nil {
+	ttl, _ := strconv.Atoi(ttlStr)
+	_, err = g.store(r.Context(), &cachepb.SetRequest{Key: key, Value: value, Ttl: int64(ttl), Namespace: namespace(r)})
+	err = reportPartial(w, err)
+	switch {
+	case errors.Is(err, errNoNodes):
 		http.Error(w, "node unavailable", 500)
 		return
-	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("error closing gRPC connection: %v", err)
-		}
-	}()
-	client := cachepb.NewCacheServiceClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	ttl, _ := strconv.Atoi(ttlStr)
-	if _, err := client.Set(ctx, &cachepb.SetRequest{Key: key, Value: value, Ttl: int64(ttl)}); err != nil {
+	case err != nil:
 		http.Error(w, "set failed", 500)
 		return
 	}
@@ -118,22 +658,12 @@ func (g *Gateway) handleSet(w http.ResponseWriter, r *http.Request) {
 }
 
 func (g *Gateway) handleDelete(w http.ResponseWriter, r *http.Request) {
-	key := r.URL.Query().Get("key")
-	addr := g.getNodeAddr(key)
-	conn, err := grpc.Dial(addr, grpc.WithInsecure())
-	if err != nil {
+	err := reportPartial(w, g.remove(r.Context(), namespace(r), r.URL.Query().Get("key"), nil))
+	switch {
+	case errors.Is(err, errNoNodes):
 		http.Error(w, "node unavailable", 500)
 		return
-	}
-	defer func() {
-		if err := conn.Close(); err != nil {
-			log.Printf("error closing gRPC connection: %v", err)
-		}
-	}()
-	client := cachepb.NewCacheServiceClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	defer cancel()
-	if _, err := client.Delete(ctx, &cachepb.DeleteRequest{Key: key}); err != nil {
+	case err != nil:
 		http.Error(w, "delete failed", 500)
 		return
 	}
@@ -151,20 +681,21 @@ func (g *Gateway) handleBenchmark(w http.ResponseWriter, r *http.Request) {
 		key := "bench" + strconv.Itoa(i)
 		node := g.ring.GetNode(key)
 		dist[node]++
-		addr := g.nodes[node]
-		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		addr := g.addr(node)
+		conn, err := g.dial(addr)
 		if err == nil {
 			client := cachepb.NewCacheServiceClient(conn)
-			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			_, timeout := g.settings()
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
 			if _, err := client.Set(ctx, &cachepb.SetRequest{Key: key, Value: []byte("value"), Ttl: 60}); err != nil {
-				log.Printf("benchmark set error: %v", err)
+				slog.WarnContext(ctx, "benchmark set failed", tracing.LogKeyHash(key), "node", node, "err", err)
 			}
 			if _, err := client.Get(ctx, &cachepb.GetRequest{Key: key}); err != nil {
-				log.Printf("benchmark get error: %v", err)
+				slog.WarnContext(ctx, "benchmark get failed", tracing.LogKeyHash(key), "node", node, "err", err)
 			}
 			cancel()
 			if err := conn.Close(); err != nil {
-				log.Printf("error closing gRPC connection: %v", err)
+				slog.WarnContext(r.Context(), "error closing gRPC connection", "node", node, "err", err)
 			}
 		}
 	}
@@ -173,6 +704,223 @@ func (g *Gateway) handleBenchmark(w http.ResponseWriter, r *http.Request) {
 		"latency_ms":   elapsed.Milliseconds(),
 		"distribution": dist,
 	}); err != nil {
-		log.Printf("error encoding benchmark response: %v", err)
+		slog.WarnContext(r.Context(), "error encoding benchmark response", "err", err)
+	}
+}
+
+func (g *Gateway) handleRing(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("format") == "binary" {
+		data, err := g.ring.MarshalBinary()
+		if err != nil {
+			http.Error(w, "encoding failed", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if _, err := w.Write(data); err != nil {
+			slog.WarnContext(r.Context(), "error writing ring", "err", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(g.ring); err != nil {
+		slog.WarnContext(r.Context(), "error encoding ring", "err", err)
+	}
+}
+
+type nodeInfo struct {
+	Name   string `json:"name"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+	Zone   string `json:"zone,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+	Host   string `json:"host,omitempty"`
+}
+
+func (g *Gateway) handleNodes(w http.ResponseWriter, r *http.Request) {
+	snapshot := g.ring.Snapshot()
+	addrs := g.nodeAddrs()
+	nodes := make([]nodeInfo, 0, len(snapshot.Nodes))
+	for _, n := range snapshot.Nodes {
+		nodes = append(nodes, nodeInfo{Name: n.Name, Addr: addrs[n.Name], Weight: n.Weight, Zone: n.Zone, Rack: n.Rack, Host: n.Host})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(nodes); err != nil {
+		slog.WarnContext(r.Context(), "error encoding nodes", "err", err)
+	}
+}
+
+// handleLocate reports where key lives: its ring owner, the replicas writes
+// go to, and the order a read would try them in right now, which bounded
+// load and zone preference may put ahead of the owner.
+func (g *Gateway) handleLocate(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	replicas := g.replicaNodes(key)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":      key,
+		"owner":    g.ring.GetNode(key),
+		"replicas": replicas,
+		"read":     g.ring.PickAmong(replicas),
+		"epoch":    g.ring.Epoch(),
+	}); err != nil {
+		slog.WarnContext(r.Context(), "error encoding location", tracing.LogKeyHash(key), "err", err)
+	}
+}
+
+// flushResult answers /flush. With replication every copy of a key is
+// counted, so RemovedCopies is the sum over nodes, not the number of keys.
+type flushResult struct {
+	Namespace     string   `json:"namespace"`
+	RemovedCopies int64    `json:"removed_copies"`
+	Flushed       []string `json:"flushed"`
+	Failed        []string `json:"failed,omitempty"`
+}
+
+// handleFlush drops every key of one namespace on every node. Only POST is
+// accepted so a stray GET cannot wipe a tenant. A node failing does not stop
+// the others; like a partial write, the response names the nodes that
+// failed and is only an error when none could be flushed.
+func (g *Gateway) handleFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	res := flushResult{Namespace: namespace(r), Flushed: []string{}}
+	nodes := slices.Sorted(maps.Keys(g.nodeAddrs()))
+	for _, node := range nodes {
+		err := g.withNode(r.Context(), node, "flush", func(ctx context.Context, client cachepb.CacheServiceClient) error {
+			resp, err := client.FlushAll(ctx, &cachepb.FlushAllRequest{Namespace: res.Namespace})
+			if err == nil {
+				res.RemovedCopies += resp.Removed
+			}
+			return err
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "flush failed", "namespace", res.Namespace, "node", node, "err", err)
+			res.Failed = append(res.Failed, node)
+			continue
+		}
+		res.Flushed = append(res.Flushed, node)
+	}
+	if len(nodes) > 0 && len(res.Flushed) == 0 {
+		http.Error(w, "flush failed", 500)
+		return
+	}
+	if len(res.Failed) > 0 {
+		g.metrics.partialWrites.WithLabelValues("flush").Inc()
+		w.Header().Set(failedReplicasHeader, strings.Join(res.Failed, ","))
+	}
+	slog.InfoContext(r.Context(), "namespace flushed", "namespace", res.Namespace, "removed_copies", res.RemovedCopies,
+		"failed", res.Failed)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		slog.WarnContext(r.Context(), "error encoding flush result", "err", err)
+	}
+}
+
+type watchEvent struct {
+	Node      string `json:"node"`
+	Type      string `json:"type"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+}
+
+// handleWatch fans in Watch streams from every node and relays them as
+// server-sent events. With replication, each change arrives once per replica.
+func (g *Gateway) handleWatch(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", 500)
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.WarnContext(r.Context(), "error clearing write deadline", "err", err)
+	}
+	req := &cachepb.WatchRequest{
+		Prefix:        r.URL.Query().Get("prefix"),
+		IncludeValues: r.URL.Query().Get("values") == "true",
+		Namespace:     namespace(r),
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events := make(chan watchEvent, 256)
+	for node, addr := range g.nodeAddrs() {
+		go g.watchNode(ctx, node, addr, req, events)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-g.shutdown:
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case ev := <-events:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.WarnContext(ctx, "error encoding watch event", "err", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// watchNode relays one node's Watch stream until ctx ends, reconnecting
+// after errors.
+func (g *Gateway) watchNode(ctx context.Context, node, addr string, req *cachepb.WatchRequest, events chan<- watchEvent) {
+	for ctx.Err() == nil {
+		err := func() error {
+			conn, err := g.dial(addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			stream, err := cachepb.NewCacheServiceClient(conn).Watch(ctx, req)
+			if err != nil {
+				return err
+			}
+			for {
+				msg, err := stream.Recv()
+				if err != nil {
+					return err
+				}
+				ev := watchEvent{
+					Node:      node,
+					Type:      strings.ToLower(strings.TrimPrefix(msg.Type.String(), "EVENT_TYPE_")),
+					Namespace: msg.Namespace,
+					Key:       msg.Key,
+					Value:     msg.Value,
+				}
+				select {
+				case events <- ev:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}()
+		if ctx.Err() != nil {
+			return
+		}
+		slog.WarnContext(ctx, "watch failed, retrying", "node", node, "err", err)
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+		}
 	}
 }
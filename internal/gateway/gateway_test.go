@@ -0,0 +1,1242 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shardo/internal/auth"
+	"shardo/internal/logging"
+	"shardo/internal/ratelimit"
+	"shardo/internal/tlsutil"
+	"shardo/internal/tlsutil/tlstest"
+	"shardo/internal/tracing"
+	"shardo/internal/tracing/tracingtest"
+	"shardo/pkg/cache"
+	"shardo/pkg/hashring"
+	"shardo/proto/cachepb"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+func TestRoutePrefersLocalZone(t *testing.T) {
+	g := NewGateway(GatewayConfig{
+		Nodes: map[string]string{"n1": "n1:1", "n2": "n2:1", "n3": "n3:1"},
+		NodeLabels: map[string]hashring.Labels{
+			"n1": {Zone: "a"},
+			"n2": {Zone: "b"},
+			"n3": {Zone: "c"},
+		},
+		Zone:              "b",
+		Replicas:          50,
+		ReplicationFactor: 3,
+		Registry:          prometheus.NewRegistry(),
+	})
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		nodes, release := g.route(key, true)
+		if len(nodes) != 3 || nodes[0] != "n2" {
+			t.Fatalf("expected local replica n2 first, got %v", nodes)
+		}
+		release()
+		// Writes keep ring order: the owner checks If-Match for everyone.
+		nodes, release = g.route(key, false)
+		if owner := g.ring.GetReplicas(key, 3)[0]; len(nodes) != 3 || nodes[0] != owner {
+			t.Fatalf("expected writes to go to the owner %s first, got %v", owner, nodes)
+		}
+		release()
+	}
+	for n, load := range g.ring.Loads() {
+		if load != 0 {
+			t.Fatalf("expected load on %s to be released, got %d", n, load)
+		}
+	}
+}
+
+func TestRouteWithoutReplication(t *testing.T) {
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": "n1:1", "n2": "n2:1"},
+		Replicas:          50,
+		ReplicationFactor: 1,
+		Registry:          prometheus.NewRegistry(),
+	})
+	nodes, release := g.route("foo", true)
+	defer release()
+	if len(nodes) != 1 || nodes[0] != g.ring.GetNode("foo") {
+		t.Fatalf("expected owner of foo, got %v", nodes)
+	}
+}
+
+func TestRouteSpillsReadsOnlyToReplicas(t *testing.T) {
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": "n1:1", "n2": "n2:1", "n3": "n3:1", "n4": "n4:1"},
+		Replicas:          50,
+		ReplicationFactor: 2,
+		LoadEpsilon:       0.1,
+		Registry:          prometheus.NewRegistry(),
+	})
+	replicas := g.replicaNodes("hot")
+	first := make(map[string]int)
+	var releases []func()
+	for i := 0; i < 20; i++ {
+		nodes, release := g.route("hot", true)
+		releases = append(releases, release)
+		first[nodes[0]]++
+		if !slices.Contains(replicas, nodes[0]) {
+			t.Fatalf("expected reads to stay on replicas %v, got %v", replicas, nodes)
+		}
+	}
+	if len(first) != 2 {
+		t.Fatalf("expected busy reads to spread over both replicas, got %v", first)
+	}
+	nodes, release := g.route("hot", false)
+	if !slices.Equal(nodes, replicas) {
+		t.Fatalf("expected writes to go to every replica %v under load, got %v", replicas, nodes)
+	}
+	release()
+	for _, release := range releases {
+		release()
+	}
+	for n, load := range g.ring.Loads() {
+		if load != 0 {
+			t.Fatalf("expected load on %s to be released, got %d", n, load)
+		}
+	}
+}
+
+func TestNodesAndLocate(t *testing.T) {
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": "h1:1", "n2": "h2:1", "n3": "h3:1"},
+		NodeLabels:        map[string]hashring.Labels{"n1": {Zone: "a", Rack: "r1"}, "n2": {Zone: "b"}, "n3": {Zone: "c"}},
+		NodeWeights:       map[string]int{"n3": 2},
+		Replicas:          50,
+		ReplicationFactor: 2,
+		LoadEpsilon:       0.1,
+		Registry:          prometheus.NewRegistry(),
+	})
+	h := g.handler()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/nodes", nil))
+	var nodes []nodeInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	want := []nodeInfo{{"n1", "h1:1", 1, "a", "r1", ""}, {"n2", "h2:1", 1, "b", "", ""}, {"n3", "h3:1", 2, "c", "", ""}}
+	if !slices.Equal(nodes, want) {
+		t.Fatalf("expected nodes %+v, got %+v", want, nodes)
+	}
+
+	type location struct {
+		Key      string
+		Owner    string
+		Replicas []string
+		Read     []string
+		Epoch    uint64
+	}
+	locate := func() location {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/locate?key=hot", nil))
+		var loc location
+		if err := json.Unmarshal(rec.Body.Bytes(), &loc); err != nil {
+			t.Fatal(err)
+		}
+		return loc
+	}
+	loc := locate()
+	replicas := g.replicaNodes("hot")
+	if loc.Key != "hot" || loc.Owner != replicas[0] || !slices.Equal(loc.Replicas, replicas) ||
+		!slices.Equal(loc.Read, replicas) || loc.Epoch != g.ring.Epoch() {
+		t.Fatalf("expected an idle ring to read from the owner, got %+v", loc)
+	}
+	// Load the owner past its bound: reads now go to the other replica.
+	for i := 0; i < 10; i++ {
+		g.ring.AcquireNode(replicas[0])
+	}
+	if loc := locate(); loc.Owner != replicas[0] || loc.Read[0] != replicas[1] {
+		t.Fatalf("expected reads of a busy owner to move to %s, got %+v", replicas[1], loc)
+	}
+}
+
+func TestGatewayMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": "127.0.0.1:1", "n2": "127.0.0.1:1"},
+		Replicas:          50,
+		ReplicationFactor: 1,
+		Registry:          reg,
+	})
+	rec := httptest.NewRecorder()
+	g.instrument("/get", g.handleGet)(rec, httptest.NewRequest("GET", "/get?key=foo", nil))
+	if rec.Code != 404 {
+		t.Fatalf("expected 404 from unreachable node, got %d", rec.Code)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, f := range families {
+		byName[f.GetName()] = f
+	}
+	if got := byName["gateway_ring_nodes"].GetMetric()[0].GetGauge().GetValue(); got != 2 {
+		t.Fatalf("expected 2 ring nodes, got %v", got)
+	}
+	if n := len(byName["gateway_ring_ownership_ratio"].GetMetric()); n != 2 {
+		t.Fatalf("expected ownership for 2 nodes, got %d", n)
+	}
+	req := byName["gateway_http_requests_total"].GetMetric()
+	if len(req) != 1 || req[0].GetCounter().GetValue() != 1 || labelValue(req[0], "code") != "404" {
+		t.Fatalf("expected one 404 on /get, got %v", req)
+	}
+	dial := byName["gateway_node_dial_failures_total"].GetMetric()
+	if len(dial) != 1 || labelValue(dial[0], "node") != g.ring.GetNode("foo") {
+		t.Fatalf("expected a dial failure on the owner of foo, got %v", dial)
+	}
+	calls := byName["gateway_node_requests_total"].GetMetric()
+	if len(calls) != 1 || labelValue(calls[0], "code") != "Unavailable" || labelValue(calls[0], "op") != "get" {
+		t.Fatalf("expected one unavailable get, got %v", calls)
+	}
+}
+
+func TestReload(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": "n1:1", "n2": "n2:1", "n3": "n3:1"},
+		NodeLabels:        map[string]hashring.Labels{"n1": {Zone: "a"}},
+		Replicas:          50,
+		ReplicationFactor: 1,
+		Registry:          reg,
+	})
+	g.Reload(GatewayConfig{
+		Nodes:             map[string]string{"n1": "n1:1", "n2": "n2:2", "n4": "n4:1"},
+		NodeLabels:        map[string]hashring.Labels{"n1": {Zone: "b"}},
+		NodeWeights:       map[string]int{"n2": 3},
+		ReplicationFactor: 2,
+		RequestTimeout:    time.Second,
+	})
+
+	nodes := g.ring.Nodes()
+	sort.Strings(nodes)
+	if len(nodes) != 3 || nodes[0] != "n1" || nodes[1] != "n2" || nodes[2] != "n4" {
+		t.Fatalf("expected ring n1, n2, n4, got %v", nodes)
+	}
+	if z := g.ring.Labels("n1").Zone; z != "b" {
+		t.Fatalf("expected n1 relabelled to zone b, got %q", z)
+	}
+	if w := g.ring.Weight("n2"); w != 3 {
+		t.Fatalf("expected n2 weight 3, got %d", w)
+	}
+	if addr := g.addr("n2"); addr != "n2:2" {
+		t.Fatalf("expected new address for n2, got %s", addr)
+	}
+	if rf, timeout := g.settings(); rf != 2 || timeout != time.Second {
+		t.Fatalf("expected replication 2 and 1s timeout, got %d and %v", rf, timeout)
+	}
+	if got := len(g.replicaNodes("foo")); got != 2 {
+		t.Fatalf("expected 2 replicas after reload, got %d", got)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != "gateway_ring_ownership_ratio" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if labelValue(m, "node") == "n3" {
+				t.Fatal("expected ownership of removed node n3 to be dropped")
+			}
+		}
+	}
+}
+
+func TestReloadKeepsSharedRing(t *testing.T) {
+	src := hashring.New(50)
+	src.AddNodeWithWeight("n1", 2, hashring.Labels{Zone: "a"})
+	src.AddNodeWithWeight("n2", 1, hashring.Labels{Zone: "b"})
+	data, err := src.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := hashring.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": "n1:1", "n2": "n2:1"},
+		Ring:              ring,
+		ReplicationFactor: 1,
+		Registry:          prometheus.NewRegistry(),
+	})
+	epoch := ring.Epoch()
+	owners := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		owners[key] = ring.GetNode(key)
+	}
+
+	// Labels and weights differ from the file and n3 is only in the config.
+	err = g.Reload(GatewayConfig{
+		Nodes:             map[string]string{"n1": "n1:2", "n2": "n2:1", "n3": "n3:1"},
+		NodeLabels:        map[string]hashring.Labels{"n1": {Zone: "c"}},
+		ReplicationFactor: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ring.Epoch() != epoch {
+		t.Fatalf("expected the ring epoch to stay %d, got %d", epoch, ring.Epoch())
+	}
+	for key, owner := range owners {
+		if got := ring.GetNode(key); got != owner {
+			t.Fatalf("%s: expected owner %s to stay, got %s", key, owner, got)
+		}
+	}
+	if addr := g.addr("n1"); addr != "n1:2" {
+		t.Fatalf("expected the new address for n1, got %s", addr)
+	}
+	if rf, _ := g.settings(); rf != 2 {
+		t.Fatalf("expected the other settings to apply, got replication %d", rf)
+	}
+
+	err = g.Reload(GatewayConfig{Nodes: map[string]string{"n1": "n1:3"}, ReplicationFactor: 1})
+	if err == nil || !strings.Contains(err.Error(), "n2") {
+		t.Fatalf("expected a reload dropping n2's address to be rejected, got %v", err)
+	}
+	if addr, rf := g.addr("n1"), g.replicationFactor; addr != "n1:2" || rf != 2 {
+		t.Fatalf("expected a rejected reload to change nothing, got %s and replication %d", addr, rf)
+	}
+}
+
+func labelValue(m *dto.Metric, name string) string {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestGatewaySpans(t *testing.T) {
+	recorder := tracingtest.Install()
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": "127.0.0.1:1"},
+		Replicas:          10,
+		ReplicationFactor: 1,
+		Registry:          prometheus.NewRegistry(),
+	})
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/get?key=foo", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	g.instrument("/get", g.handleGet)(httptest.NewRecorder(), req)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	root, call := spans["GET /get"], spans["node.get"]
+	if root == nil || call == nil {
+		t.Fatalf("expected route and node spans, got %v", spans)
+	}
+	if root.SpanContext().TraceID().String() != traceID {
+		t.Fatalf("expected incoming trace %s, got %s", traceID, root.SpanContext().TraceID())
+	}
+	if call.Parent().SpanID() != root.SpanContext().SpanID() {
+		t.Fatal("expected node span to be a child of the route span")
+	}
+	var node string
+	for _, kv := range call.Attributes() {
+		if kv.Key == tracing.AttrNode {
+			node = kv.Value.AsString()
+		}
+	}
+	if node != "n1" {
+		t.Fatalf("expected node attribute n1, got %q", node)
+	}
+}
+
+func TestInstrumentKeepsRequestID(t *testing.T) {
+	g := NewGateway(GatewayConfig{Replicas: 10, Registry: prometheus.NewRegistry()})
+	var seen string
+	handler := g.instrument("/nodes", func(w http.ResponseWriter, r *http.Request) {
+		seen = logging.RequestID(r.Context())
+	})
+
+	req := httptest.NewRequest("GET", "/nodes", nil)
+	req.Header.Set(logging.RequestIDHeader, "abc")
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if seen != "abc" || rec.Header().Get(logging.RequestIDHeader) != "abc" {
+		t.Fatalf("expected request id abc to be kept, got %q and %q", seen, rec.Header().Get(logging.RequestIDHeader))
+	}
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/nodes", nil))
+	if id := rec.Header().Get(logging.RequestIDHeader); id == "" || id != seen {
+		t.Fatalf("expected a generated request id, got %q", id)
+	}
+}
+
+func TestServeDrainsRequestsAndEndsWatchStreams(t *testing.T) {
+	node := newMemNode()
+	node.put("default", "delayed", "v")
+	g := newTestGateway(t, GatewayConfig{ShutdownTimeout: 2 * time.Second}, node)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + lis.Addr().String()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- g.serve(ctx, lis) }()
+
+	watch, err := http.Get(base + "/watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watch.Body.Close()
+	if watch.StatusCode != 200 {
+		t.Fatalf("expected watch stream, got %d", watch.StatusCode)
+	}
+	// The node takes 500ms to answer; shutdown starts while it is working.
+	got := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/v2/keys/delayed")
+		if err != nil {
+			t.Error(err)
+			got <- 0
+			return
+		}
+		resp.Body.Close()
+		got <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	if _, err := io.ReadAll(watch.Body); err != nil {
+		t.Fatalf("expected watch stream to end cleanly, got %v", err)
+	}
+	if code := <-got; code != 200 {
+		t.Fatalf("expected the in-flight request to finish with 200, got %d", code)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve did not return after shutdown")
+	}
+}
+
+func TestAuthorizeRoutes(t *testing.T) {
+	g := NewGateway(GatewayConfig{
+		Nodes:    map[string]string{"n1": "127.0.0.1:1"},
+		Replicas: 10,
+		Registry: prometheus.NewRegistry(),
+		Auth: auth.NewGuard(auth.Policy{
+			{Principal: "team-a", Prefixes: []string{"a:"}, Operations: []auth.Operation{auth.OpRead}},
+			{Principal: "team-b", Namespaces: []string{"team-b"}, Prefixes: []string{""}, Operations: []auth.Operation{auth.OpRead}},
+			{Principal: "ops", Operations: []auth.Operation{auth.OpAdmin}},
+		}, auth.NewAPIKeys(map[string]string{"key-a": "team-a", "key-b": "team-b", "key-ops": "ops"})),
+	})
+	h := g.handler()
+	cases := []struct {
+		url  string
+		key  string
+		want int
+	}{
+		{"/locate?key=a:1", "", 401},
+		{"/locate?key=a:1", "wrong", 401},
+		{"/locate?key=a:1", "key-a", 200},
+		{"/locate?key=b:1", "key-a", 403},
+		{"/set?key=a:1", "key-a", 403},
+		{"/locate?key=x&namespace=team-b", "key-b", 200},
+		{"/locate?key=x", "key-b", 403},
+		{"/locate?key=x&namespace=no/slashes", "key-b", 400},
+		{"/flush?namespace=team-b", "key-b", 403},
+		{"/nodes", "key-a", 403},
+		{"/nodes", "key-ops", 200},
+		{"/metrics", "", 200},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest("GET", tc.url, nil)
+		if tc.key != "" {
+			req.Header.Set(auth.APIKeyHeader, tc.key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("%s with key %q: expected %d, got %d", tc.url, tc.key, tc.want, rec.Code)
+		}
+		if rec.Code == 401 && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("%s: expected a WWW-Authenticate header on 401", tc.url)
+		}
+	}
+
+	g.Reload(GatewayConfig{Nodes: map[string]string{"n1": "127.0.0.1:1"}, ReplicationFactor: 1})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/nodes", nil))
+	if rec.Code != 200 {
+		t.Fatalf("expected reload without auth to open the gateway, got %d", rec.Code)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	shedder := ratelimit.NewShedder(1, 1, 0)
+	g := NewGateway(GatewayConfig{
+		Nodes:     map[string]string{"n1": "127.0.0.1:1"},
+		Replicas:  10,
+		Registry:  reg,
+		RateLimit: ratelimit.NewLimiter(1, 2),
+		Shedder:   shedder,
+		Auth: auth.NewGuard(auth.Policy{{Principal: "*", Prefixes: []string{""}, Operations: []auth.Operation{auth.OpRead}}},
+			auth.NewAPIKeys(map[string]string{"key-a": "team-a", "key-b": "team-b"})),
+	})
+	h := g.handler()
+	get := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/locate?key=x", nil)
+		req.Header.Set(auth.APIKeyHeader, key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for i, want := range []int{200, 200, 429} {
+		if rec := get("key-a"); rec.Code != want {
+			t.Fatalf("request %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+	if rec := get("key-a"); rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected Retry-After on 429, got %q", rec.Header().Get("Retry-After"))
+	}
+	if rec := get("key-b"); rec.Code != 200 {
+		t.Fatalf("expected another client to have its own bucket, got %d", rec.Code)
+	}
+	// Failed attempts draw from a bucket per IP, checked before auth.
+	for i, want := range []int{401, 401, 429} {
+		if rec := get("made-up-" + strconv.Itoa(i)); rec.Code != want {
+			t.Fatalf("made-up key %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+
+	release, _ := shedder.Acquire()
+	rec := get("key-b")
+	release()
+	if rec.Code != 503 || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After at the concurrency limit, got %d", rec.Code)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() == "gateway_rejected_requests_total" {
+			for _, m := range f.GetMetric() {
+				rejected[labelValue(m, "reason")] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	if rejected["rate_limit"] != 2 || rejected["auth_rate_limit"] != 1 || rejected["overload"] != 1 {
+		t.Fatalf("expected 2 rate limited, 1 auth rate limited and 1 shed request, got %v", rejected)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	cases := []struct {
+		name       string
+		forwarded  []string
+		trustProxy bool
+		want       string
+	}{
+		{"no proxy", nil, true, "192.0.2.1"},
+		{"header ignored without trust_proxy", []string{"203.0.113.9"}, false, "192.0.2.1"},
+		{"single entry", []string{"203.0.113.9"}, true, "203.0.113.9"},
+		{"client-supplied entries are skipped", []string{"10.0.0.1, 203.0.113.9"}, true, "203.0.113.9"},
+		{"last header wins", []string{"10.0.0.1", "198.51.100.7, 203.0.113.9"}, true, "203.0.113.9"},
+		{"empty last entry", []string{"10.0.0.1,"}, true, "192.0.2.1"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/get?key=x", nil)
+		for _, v := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientIP(r, tc.trustProxy); got != tc.want {
+			t.Fatalf("%s: expected %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	node := newMemNode()
+	for _, key := range []string{"x", "y", "z"} {
+		node.put("team-a", key, "v")
+	}
+	g := newTestGateway(t, GatewayConfig{}, node)
+	h := g.handler()
+	cases := []struct {
+		method string
+		url    string
+		want   int
+	}{
+		{"GET", "/get?key=a&namespace=team-a", 404},
+		{"GET", "/get?key=a", 404},
+		{"GET", "/get?key=a&namespace=" + strings.Repeat("x", 65), 400},
+		{"GET", "/flush?namespace=team-a", 405},
+		{"POST", "/flush?namespace=team-a", 200},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, nil))
+		if rec.Code != tc.want {
+			t.Fatalf("%s %s: expected %d, got %d", tc.method, tc.url, tc.want, rec.Code)
+		}
+		if tc.method == "POST" && !strings.Contains(rec.Body.String(), `"removed_copies":3`) {
+			t.Fatalf("expected the flush result, got %s", rec.Body)
+		}
+	}
+	want := []string{"get team-a", "get default", "flush team-a"}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if !slices.Equal(node.seen, want) {
+		t.Fatalf("expected nodes to see %v, got %v", want, node.seen)
+	}
+}
+
+// memNode is an in-memory node honouring if_match like real nodes do. It
+// records the operations it serves, streams sets and deletes to watchers,
+// and reads of "slow" hang until the caller gives up.
+type memNode struct {
+	cachepb.UnimplementedCacheServiceServer
+	mu       sync.Mutex
+	items    map[string]*cachepb.SetRequest
+	seen     []string
+	watchers []chan *cachepb.WatchEvent
+	down     bool // fail writes with Unavailable
+}
+
+func newMemNode() *memNode {
+	return &memNode{items: make(map[string]*cachepb.SetRequest)}
+}
+
+// put stores a value without going through the gateway.
+func (n *memNode) put(namespace, key, value string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.items[namespace+"/"+key] = &cachepb.SetRequest{Namespace: namespace, Key: key, Value: []byte(value), Ttl: 60}
+}
+
+func (n *memNode) record(op, namespace string) {
+	n.seen = append(n.seen, op+" "+namespace)
+}
+
+func (n *memNode) Get(ctx context.Context, req *cachepb.GetRequest) (*cachepb.GetResponse, error) {
+	switch req.Key {
+	case "slow":
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case "delayed":
+		select {
+		case <-time.After(500 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.record("get", req.Namespace)
+	it, ok := n.items[req.Namespace+"/"+req.Key]
+	if !ok {
+		return &cachepb.GetResponse{}, nil
+	}
+	return &cachepb.GetResponse{Value: it.Value, Found: true, ContentType: it.ContentType,
+		Etag: cache.ETag(it.Value, it.ContentType), TtlMs: it.Ttl * 1000}, nil
+}
+
+func (n *memNode) Set(_ context.Context, req *cachepb.SetRequest) (*cachepb.SetResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.record("set", req.Namespace)
+	if n.down {
+		return nil, status.Error(codes.Unavailable, "node down")
+	}
+	if !n.matches(req.Namespace+"/"+req.Key, req.IfMatch) {
+		return nil, status.Error(codes.FailedPrecondition, "etag does not match")
+	}
+	n.items[req.Namespace+"/"+req.Key] = req
+	n.publish(&cachepb.WatchEvent{Type: cachepb.EventType_EVENT_TYPE_SET, Namespace: req.Namespace, Key: req.Key, Value: req.Value})
+	return &cachepb.SetResponse{Etag: cache.ETag(req.Value, req.ContentType)}, nil
+}
+
+func (n *memNode) Delete(_ context.Context, req *cachepb.DeleteRequest) (*cachepb.DeleteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.record("delete", req.Namespace)
+	if n.down {
+		return nil, status.Error(codes.Unavailable, "node down")
+	}
+	if !n.matches(req.Namespace+"/"+req.Key, req.IfMatch) {
+		return nil, status.Error(codes.FailedPrecondition, "etag does not match")
+	}
+	delete(n.items, req.Namespace+"/"+req.Key)
+	n.publish(&cachepb.WatchEvent{Type: cachepb.EventType_EVENT_TYPE_DELETE, Namespace: req.Namespace, Key: req.Key})
+	return &cachepb.DeleteResponse{}, nil
+}
+
+func (n *memNode) Watch(req *cachepb.WatchRequest, stream cachepb.CacheService_WatchServer) error {
+	ch := make(chan *cachepb.WatchEvent, 16)
+	n.mu.Lock()
+	n.record("watch", req.Namespace)
+	n.watchers = append(n.watchers, ch)
+	n.mu.Unlock()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case ev := <-ch:
+			if ev.Namespace != req.Namespace || !strings.HasPrefix(ev.Key, req.Prefix) {
+				continue
+			}
+			if !req.IncludeValues {
+				ev = &cachepb.WatchEvent{Type: ev.Type, Namespace: ev.Namespace, Key: ev.Key}
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// publish hands ev to every watcher. It must be called with n.mu held.
+func (n *memNode) publish(ev *cachepb.WatchEvent) {
+	for _, ch := range n.watchers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (n *memNode) watching() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.watchers)
+}
+
+func (n *memNode) FlushAll(_ context.Context, req *cachepb.FlushAllRequest) (*cachepb.FlushAllResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.record("flush", req.Namespace)
+	if n.down {
+		return nil, status.Error(codes.Unavailable, "node down")
+	}
+	var removed int64
+	for id, it := range n.items {
+		if it.Namespace == req.Namespace {
+			delete(n.items, id)
+			removed++
+		}
+	}
+	return &cachepb.FlushAllResponse{Removed: removed}, nil
+}
+
+func (n *memNode) matches(id string, ifMatch []string) bool {
+	if ifMatch == nil {
+		return true
+	}
+	it, ok := n.items[id]
+	return ok && (slices.Contains(ifMatch, "*") || slices.Contains(ifMatch, cache.ETag(it.Value, it.ContentType)))
+}
+
+// startNode serves node over gRPC until the test ends and returns its address.
+func startNode(t *testing.T, node cachepb.CacheServiceServer, opts ...grpc.ServerOption) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(opts...)
+	cachepb.RegisterCacheServiceServer(srv, node)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+// newTestGateway starts nodes as n1, n2, ... and builds a gateway over them
+// from cfg, filling in the ring settings tests rarely care about.
+func newTestGateway(t *testing.T, cfg GatewayConfig, nodes ...*memNode) *Gateway {
+	t.Helper()
+	cfg.Nodes = make(map[string]string, len(nodes))
+	for i, n := range nodes {
+		cfg.Nodes["n"+strconv.Itoa(i+1)] = startNode(t, n)
+	}
+	if cfg.Replicas == 0 {
+		cfg.Replicas = 10
+	}
+	if cfg.ReplicationFactor == 0 {
+		cfg.ReplicationFactor = 1
+	}
+	if cfg.Registry == nil {
+		cfg.Registry = prometheus.NewRegistry()
+	}
+	return NewGateway(cfg)
+}
+
+func TestGetTriesReplicasOnMiss(t *testing.T) {
+	nodes := map[string]*memNode{"n1": newMemNode(), "n2": newMemNode()}
+	g := newTestGateway(t, GatewayConfig{ReplicationFactor: 2}, nodes["n1"], nodes["n2"])
+	h := g.handler()
+	for _, key := range []string{"a", "b", "c"} {
+		// Only the replica read last has the key, as if the first missed the write.
+		replicas := g.replicaNodes(key)
+		nodes[replicas[1]].put("default", key, "from "+replicas[1])
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/get?key="+key, nil))
+		if rec.Code != 200 || rec.Body.String() != "from "+replicas[1] {
+			t.Fatalf("GET %s: expected the value from %s, got %d %q", key, replicas[1], rec.Code, rec.Body)
+		}
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/get?key=missing", nil))
+	if rec.Code != 404 {
+		t.Fatalf("expected a miss on every replica to be a 404, got %d", rec.Code)
+	}
+}
+
+func TestWatchFansInNodes(t *testing.T) {
+	n1, n2 := newMemNode(), newMemNode()
+	srv := httptest.NewServer(newTestGateway(t, GatewayConfig{}, n1, n2).handler())
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/watch?prefix=user:&values=true&namespace=team-a", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	for n1.watching() == 0 || n2.watching() == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("gateway never watched both nodes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	n1.Set(ctx, &cachepb.SetRequest{Namespace: "team-a", Key: "user:1", Value: []byte("a")})
+	n2.Set(ctx, &cachepb.SetRequest{Namespace: "team-a", Key: "other:1", Value: []byte("b")})
+	n2.Set(ctx, &cachepb.SetRequest{Namespace: "default", Key: "user:9", Value: []byte("c")})
+	n2.Delete(ctx, &cachepb.DeleteRequest{Namespace: "team-a", Key: "user:2"})
+
+	var got []watchEvent
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for len(got) < 2 && scanner.Scan() {
+		line := scanner.Text()
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			event = name
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var ev watchEvent
+			if err := json.Unmarshal([]byte(data), &ev); err != nil || ev.Type != event {
+				t.Fatalf("bad event %s %q: %v", event, data, err)
+			}
+			got = append(got, ev)
+		}
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Node < got[j].Node })
+	want := []watchEvent{
+		{Node: "n1", Type: "set", Namespace: "team-a", Key: "user:1", Value: []byte("a")},
+		{Node: "n2", Type: "delete", Namespace: "team-a", Key: "user:2"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %+v, got %+v (%v)", want, got, scanner.Err())
+	}
+	for i := range want {
+		if got[i].Node != want[i].Node || got[i].Type != want[i].Type || got[i].Namespace != want[i].Namespace ||
+			got[i].Key != want[i].Key || string(got[i].Value) != string(want[i].Value) {
+			t.Fatalf("expected %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestLogsHashKeys(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	g := NewGateway(GatewayConfig{
+		Nodes:          map[string]string{"n1": "127.0.0.1:1"},
+		Replicas:       10,
+		RequestTimeout: 100 * time.Millisecond,
+		Registry:       prometheus.NewRegistry(),
+	})
+	h := g.handler()
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/get?key=user:secret", nil),
+		httptest.NewRequest("POST", "/set?key=user:secret&ttl=60", strings.NewReader("v")),
+		httptest.NewRequest("DELETE", "/delete?key=user:secret", nil),
+	} {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	logs := buf.String()
+	want := "key_hash=" + tracing.KeyHash("user:secret").Value.AsString()
+	if strings.Contains(logs, "user:secret") || strings.Count(logs, want) < 3 {
+		t.Fatalf("expected failures logged by %s only, got:\n%s", want, logs)
+	}
+}
+
+func TestKeysV2(t *testing.T) {
+	h := newTestGateway(t, GatewayConfig{RequestTimeout: 100 * time.Millisecond}, newMemNode()).handler()
+	cases := []struct {
+		method      string
+		url         string
+		contentType string
+		body        string
+		want        int
+		wantCode    string // error code in the JSON body
+		wantBody    string
+	}{
+		{"PUT", "/v2/keys/user/1?ttl=60", "application/json", `{"name":"Alice"}`, 204, "", ""},
+		{"GET", "/v2/keys/user/1", "", "", 200, "", `{"name":"Alice"}`},
+		{"GET", "/v2/keys/user/1?namespace=team-a", "", "", 404, "not_found", ""},
+		{"PUT", "/v2/keys/raw?ttl=60", "", "bytes", 204, "", ""},
+		{"PUT", "/v2/keys/user/1", "", "x", 400, "invalid_ttl", ""},
+		{"PUT", "/v2/keys/user/1?ttl=60", "not a type", "x", 400, "invalid_content_type", ""},
+		{"GET", "/v2/keys/", "", "", 400, "invalid_key", ""},
+		{"GET", "/v2/keys/x?namespace=no/slashes", "", "", 400, "invalid_namespace", ""},
+		{"POST", "/v2/keys/user/1", "", "", 405, "method_not_allowed", ""},
+		{"GET", "/v2/nothing", "", "", 404, "not_found", ""},
+		{"GET", "/v2/keys/slow", "", "", 504, "timeout", ""},
+		{"DELETE", "/v2/keys/user/1", "", "", 204, "", ""},
+		{"GET", "/v2/keys/user/1", "", "", 404, "not_found", ""},
+		{"GET", "/get?key=raw", "", "", 200, "", "bytes"},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.url, strings.NewReader(tc.body))
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("%s %s: expected %d, got %d (%s)", tc.method, tc.url, tc.want, rec.Code, rec.Body)
+		}
+		if tc.wantCode != "" {
+			var body struct{ Error apiError }
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Error.Code != tc.wantCode {
+				t.Fatalf("%s %s: expected error code %q, got %s", tc.method, tc.url, tc.wantCode, rec.Body)
+			}
+		}
+		if tc.wantBody != "" && rec.Body.String() != tc.wantBody {
+			t.Fatalf("%s %s: expected body %q, got %q", tc.method, tc.url, tc.wantBody, rec.Body)
+		}
+	}
+
+	for url, want := range map[string]string{"/v2/keys/raw": defaultContentType, "/v2/openapi.yaml": "application/yaml"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+		if got := rec.Header().Get("Content-Type"); rec.Code != 200 || got != want {
+			t.Fatalf("GET %s: expected 200 with %s, got %d with %s", url, want, rec.Code, got)
+		}
+	}
+
+	down := NewGateway(GatewayConfig{
+		Nodes:    map[string]string{"n1": "127.0.0.1:1"},
+		Replicas: 10,
+		Registry: prometheus.NewRegistry(),
+	})
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		rec := httptest.NewRecorder()
+		down.handler().ServeHTTP(rec, httptest.NewRequest(method, "/v2/keys/a?ttl=1", nil))
+		if rec.Code != 503 || !strings.Contains(rec.Body.String(), `"unavailable"`) {
+			t.Fatalf("%s with the node down: expected 503 unavailable, got %d (%s)", method, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	h := newTestGateway(t, GatewayConfig{RequestTimeout: 100 * time.Millisecond}, newMemNode()).handler()
+	writes := 0
+	do := func(method, url string, header ...string) *httptest.ResponseRecorder {
+		writes++
+		req := httptest.NewRequest(method, url, strings.NewReader("value "+strconv.Itoa(writes)))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("PUT", "/v2/keys/k?ttl=60")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 204 || etag == "" {
+		t.Fatalf("expected 204 with an ETag, got %d %q", rec.Code, etag)
+	}
+	rec = do("GET", "/v2/keys/k")
+	if rec.Header().Get("ETag") != etag || rec.Header().Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("expected ETag %s and max-age=60, got %v", etag, rec.Header())
+	}
+	cases := []struct {
+		method string
+		header string
+		value  string
+		want   int
+	}{
+		{"GET", "If-None-Match", etag, 304},
+		{"GET", "If-None-Match", `"other", W/` + etag, 304},
+		{"GET", "If-None-Match", "*", 304},
+		{"GET", "If-None-Match", `"other"`, 200},
+		{"PUT", "If-Match", `"stale"`, 412},
+		{"PUT", "If-Match", "W/" + etag, 412},
+		{"DELETE", "If-Match", `"stale"`, 412},
+		{"PUT", "If-Match", etag, 204},
+		{"PUT", "If-Match", etag, 412},
+		{"DELETE", "If-Match", "*", 204},
+		{"PUT", "If-Match", "*", 412},
+	}
+	for _, tc := range cases {
+		rec := do(tc.method, "/v2/keys/k?ttl=60", tc.header, tc.value)
+		if rec.Code != tc.want {
+			t.Fatalf("%s with %s: %s: expected %d, got %d (%s)", tc.method, tc.header, tc.value, tc.want, rec.Code, rec.Body)
+		}
+		if rec.Code == 304 && (rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag) {
+			t.Fatalf("expected an empty 304 carrying the ETag, got %q %v", rec.Body, rec.Header())
+		}
+		if rec.Code == 412 && !strings.Contains(rec.Body.String(), `"precondition_failed"`) {
+			t.Fatalf("expected a precondition_failed error, got %s", rec.Body)
+		}
+	}
+}
+
+func TestConditionalWritesWithReplicas(t *testing.T) {
+	nodes := map[string]*memNode{"n1": newMemNode(), "n2": newMemNode()}
+	g := newTestGateway(t, GatewayConfig{ReplicationFactor: 2}, nodes["n1"], nodes["n2"])
+	h := g.handler()
+	replicas := g.ring.GetReplicas("k", 2)
+	owner, other := nodes[replicas[0]], nodes[replicas[1]]
+	value := func(n *memNode) string {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if it, ok := n.items["default/k"]; ok {
+			return string(it.Value)
+		}
+		return "-"
+	}
+	tag := func(v string) string { return quoteETag(cache.ETag([]byte(v), "")) }
+
+	cases := []struct {
+		name         string
+		owner, other string // values before the request, "-" for none
+		method       string
+		ifMatch      string
+		want         int
+		after        string // value on both replicas after the request
+	}{
+		{"owner matches, other diverged", "a", "b", "PUT", tag("a"), 204, "new"},
+		{"only the other replica matches", "a", "b", "PUT", tag("b"), 412, ""},
+		{"key only on the other replica", "-", "b", "PUT", "*", 412, ""},
+		{"delete when the owner matches", "a", "b", "DELETE", tag("a"), 204, "-"},
+		{"delete when only the other matches", "a", "b", "DELETE", tag("b"), 412, ""},
+	}
+	for _, tc := range cases {
+		for n, v := range map[*memNode]string{owner: tc.owner, other: tc.other} {
+			n.mu.Lock()
+			delete(n.items, "default/k")
+			n.mu.Unlock()
+			if v != "-" {
+				n.put("default", "k", v)
+			}
+		}
+		req := httptest.NewRequest(tc.method, "/v2/keys/k?ttl=60", strings.NewReader("new"))
+		req.Header.Set("If-Match", tc.ifMatch)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Fatalf("%s: expected %d, got %d (%s)", tc.name, tc.want, rec.Code, rec.Body)
+		}
+		wantOwner, wantOther := tc.after, tc.after
+		if tc.after == "" {
+			// A refused condition leaves both replicas as they were.
+			wantOwner, wantOther = tc.owner, tc.other
+		}
+		if value(owner) != wantOwner || value(other) != wantOther {
+			t.Fatalf("%s: expected owner %q and other %q, got %q and %q", tc.name, wantOwner, wantOther, value(owner), value(other))
+		}
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	caFile, nodeCert, nodeKey := ca.WriteFiles(t, t.TempDir(), "node1")
+	nodeTLS, err := tlsutil.NewReloader(tlsutil.Files{CA: caFile, Cert: nodeCert, Key: nodeKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := newMemNode()
+	node.put("default", "foo", "value of foo")
+	nodeAddr := startNode(t, node, grpc.Creds(credentials.NewTLS(nodeTLS.ServerConfig())))
+
+	_, gwCert, gwKey := ca.WriteFiles(t, t.TempDir(), "127.0.0.1")
+	httpsTLS, err := tlsutil.NewReloader(tlsutil.Files{CA: caFile, Cert: gwCert, Key: gwKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialTLS, err := tlsutil.NewReloader(tlsutil.Files{CA: caFile, Cert: gwCert, Key: gwKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGateway(GatewayConfig{
+		Nodes:             map[string]string{"n1": nodeAddr},
+		Replicas:          10,
+		ReplicationFactor: 1,
+		Registry:          prometheus.NewRegistry(),
+		TLS:               httpsTLS,
+		NodeTLS:           dialTLS,
+		NodeServerName:    "node1",
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go g.serve(ctx, lis)
+
+	_, clientCert, clientKey := ca.WriteFiles(t, t.TempDir(), "client")
+	client, err := tlsutil.NewReloader(tlsutil.Files{CA: caFile, Cert: clientCert, Key: clientKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: client.ClientConfig("")}}
+	resp, err := hc.Get("https://" + lis.Addr().String() + "/get?key=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || string(body) != "value of foo" {
+		t.Fatalf("expected value from the node over mTLS, got %d %q", resp.StatusCode, body)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.PEM)
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if _, err := anonymous.Get("https://" + lis.Addr().String() + "/nodes"); err == nil {
+		t.Fatal("expected a client without a certificate to be rejected")
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	n1, n2 := newMemNode(), newMemNode()
+	reg := prometheus.NewRegistry()
+	g := newTestGateway(t, GatewayConfig{ReplicationFactor: 2, Registry: reg}, n1, n2)
+	h := g.handler()
+	n2.down = true
+	cases := []struct {
+		method, url string
+		want        int
+		failed      string
+	}{
+		{"PUT", "/v2/keys/k?ttl=60", 204, "n2"},
+		{"POST", "/set?key=k&ttl=60", 200, "n2"},
+		{"DELETE", "/v2/keys/k", 204, "n2"},
+		{"DELETE", "/delete?key=k", 200, "n2"},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.url, strings.NewReader("v")))
+		if rec.Code != tc.want || rec.Header().Get(failedReplicasHeader) != tc.failed {
+			t.Fatalf("%s %s: expected %d naming %q, got %d naming %q", tc.method, tc.url, tc.want, tc.failed,
+				rec.Code, rec.Header().Get(failedReplicasHeader))
+		}
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() == "gateway_partial_writes_total" {
+			for _, m := range f.GetMetric() {
+				partial[labelValue(m, "op")] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	if partial["set"] != 2 || partial["delete"] != 2 {
+		t.Fatalf("expected 2 partial sets and deletes counted, got %v", partial)
+	}
+
+	// With every replica down nothing was written.
+	n1.mu.Lock()
+	n1.down = true
+	n1.mu.Unlock()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("PUT", "/v2/keys/k?ttl=60", strings.NewReader("v")))
+	if rec.Code != 503 || rec.Header().Get(failedReplicasHeader) != "" {
+		t.Fatalf("expected 503 when no replica took the write, got %d", rec.Code)
+	}
+}
+
+func TestFlushReportsFailedNodes(t *testing.T) {
+	n1, n2, n3 := newMemNode(), newMemNode(), newMemNode()
+	for _, n := range []*memNode{n1, n2, n3} {
+		n.put("team-a", "k", "v")
+	}
+	h := newTestGateway(t, GatewayConfig{}, n1, n2, n3).handler()
+	flush := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/flush?namespace=team-a", nil))
+		return rec
+	}
+
+	n2.down = true
+	rec := flush()
+	want := `{"namespace":"team-a","removed_copies":2,"flushed":["n1","n3"],"failed":["n2"]}`
+	if rec.Code != 200 || strings.TrimSpace(rec.Body.String()) != want || rec.Header().Get(failedReplicasHeader) != "n2" {
+		t.Fatalf("expected the other nodes flushed and n2 reported, got %d %s %v", rec.Code, rec.Body, rec.Header())
+	}
+	// The failed node kept its keys: flush again once it is back.
+	n2.mu.Lock()
+	n2.down = false
+	n2.mu.Unlock()
+	if rec := flush(); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"removed_copies":1,`) {
+		t.Fatalf("expected n2's copy to go on the second flush, got %d %s", rec.Code, rec.Body)
+	}
+
+	for _, n := range []*memNode{n1, n2, n3} {
+		n.mu.Lock()
+		n.down = true
+		n.mu.Unlock()
+	}
+	if rec := flush(); rec.Code != 500 {
+		t.Fatalf("expected 500 when no node could be flushed, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,131 @@
+package gateway
+
+import (
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shardo/internal/auth"
+	"shardo/internal/ratelimit"
+)
+
+// shed turns the request away with 503 when the gateway is at its
+// concurrency limit. It runs before auth so a flood is rejected cheaply.
+func (g *Gateway) shed(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, shedder, _ := g.limits()
+		if shedder == nil {
+			next(w, r)
+			return
+		}
+		release, ok := shedder.Acquire()
+		g.observeShedder(shedder)
+		if !ok {
+			g.metrics.rejected.WithLabelValues(route, "overload").Inc()
+			slog.DebugContext(r.Context(), "request shed", "route", route)
+			reject(w, r, http.StatusServiceUnavailable, "overloaded", time.Second)
+			return
+		}
+		defer func() {
+			release()
+			g.observeShedder(shedder)
+		}()
+		next(w, r)
+	}
+}
+
+// throttle turns the request away with 429 when its client has run out of
+// tokens. It runs after auth, so clients are told apart by principal and
+// cannot dodge their bucket by making up API keys.
+func (g *Gateway) throttle(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter, _, trustProxy := g.limits()
+		if limiter == nil {
+			next(w, r)
+			return
+		}
+		if ok, wait := limiter.Allow(clientID(r, trustProxy)); !ok {
+			g.metrics.rejected.WithLabelValues(route, "rate_limit").Inc()
+			slog.DebugContext(r.Context(), "rate limited", "route", route, "retry_after", wait.String())
+			reject(w, r, http.StatusTooManyRequests, "rate_limited", wait)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authThrottled answers 429 and returns true when r's IP has used up its
+// bucket of failed authentication attempts. It runs before auth, where no
+// principal is known yet, so credentials cannot be guessed faster than the
+// rate limit; authenticated requests never draw from this bucket.
+func (g *Gateway) authThrottled(w http.ResponseWriter, r *http.Request, route string) bool {
+	limiter, _, trustProxy := g.limits()
+	if limiter == nil {
+		return false
+	}
+	wait := limiter.Wait(authFailureID(r, trustProxy))
+	if wait <= 0 {
+		return false
+	}
+	g.metrics.rejected.WithLabelValues(route, "auth_rate_limit").Inc()
+	slog.DebugContext(r.Context(), "authentication attempts rate limited", "route", route, "retry_after", wait.String())
+	reject(w, r, http.StatusTooManyRequests, "rate_limited", wait)
+	return true
+}
+
+// authFailed charges a failed authentication attempt to r's IP.
+func (g *Gateway) authFailed(r *http.Request) {
+	if limiter, _, trustProxy := g.limits(); limiter != nil {
+		limiter.Allow(authFailureID(r, trustProxy))
+	}
+}
+
+func authFailureID(r *http.Request, trustProxy bool) string {
+	return "auth_failures:" + clientIP(r, trustProxy)
+}
+
+func (g *Gateway) observeShedder(s *ratelimit.Shedder) {
+	limit, inflight := s.Limit()
+	g.metrics.concurrencyLimit.Set(float64(limit))
+	g.metrics.inflight.Set(float64(inflight))
+}
+
+func reject(w http.ResponseWriter, r *http.Request, status int, code string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(retryAfter.Seconds())))))
+	writeError(w, r, status, code, strings.ToLower(http.StatusText(status)))
+}
+
+// clientID identifies the caller for rate limiting: by the principal its
+// API key or token authenticated as and, with auth off, by IP.
+func clientID(r *http.Request, trustProxy bool) string {
+	if principal, ok := auth.Principal(r.Context()); ok {
+		return "principal:" + principal
+	}
+	return "ip:" + clientIP(r, trustProxy)
+}
+
+// clientIP returns the address of the caller. With trustProxy it is the
+// last X-Forwarded-For entry, the one the trusted proxy appended: the
+// entries before it come from the client and can say anything.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			last := fwd[len(fwd)-1]
+			if i := strings.LastIndexByte(last, ','); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
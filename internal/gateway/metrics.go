@@ -0,0 +1,166 @@
+package gateway
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"shardo/internal/logging"
+)
+
+var tracer = otel.Tracer("shardo/gateway")
+
+type gatewayMetrics struct {
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	nodeRequests  *prometheus.CounterVec
+	nodeDuration  *prometheus.HistogramVec
+	dialFailures  *prometheus.CounterVec
+	ringNodes     prometheus.Gauge
+	ringOwnership *prometheus.GaugeVec
+	loadSkew      prometheus.Gauge
+
+	partialWrites *prometheus.CounterVec
+
+	rejected         *prometheus.CounterVec
+	concurrencyLimit prometheus.Gauge
+	inflight         prometheus.Gauge
+}
+
+func newGatewayMetrics(reg prometheus.Registerer) *gatewayMetrics {
+	m := &gatewayMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_http_requests_total",
+			Help: "HTTP requests served, by route and status code",
+		}, []string{"route", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_http_request_duration_seconds",
+			Help:    "End-to-end HTTP request latency, by route",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		nodeRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_node_requests_total",
+			Help: "gRPC calls to cache nodes, by node, operation and status code",
+		}, []string{"node", "op", "code"}),
+		nodeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_node_request_duration_seconds",
+			Help:    "Latency of gRPC calls to cache nodes, by node and operation",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"node", "op"}),
+		dialFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_node_dial_failures_total",
+			Help: "Calls that could not reach a cache node",
+		}, []string{"node"}),
+		ringNodes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gateway_ring_nodes",
+			Help: "Nodes currently on the hash ring",
+		}),
+		ringOwnership: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "gateway_ring_ownership_ratio",
+			Help: "Share of the key space each node owns as primary",
+		}, []string{"node"}),
+		loadSkew: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gateway_ring_load_skew",
+			Help: "In-flight load of the busiest node relative to the average",
+		}),
+		partialWrites: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_partial_writes_total",
+			Help: "Writes and flushes some nodes took and others failed, by operation",
+		}, []string{"op"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "gateway_rejected_requests_total",
+			Help: "Requests turned away, by route and reason (rate_limit, auth_rate_limit or overload)",
+		}, []string{"route", "reason"}),
+		concurrencyLimit: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gateway_concurrency_limit",
+			Help: "Current cap on requests in flight, which adapts to latency",
+		}),
+		inflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gateway_inflight_requests",
+			Help: "Requests in flight counted against the concurrency limit",
+		}),
+	}
+	m.loadSkew.Set(1)
+	reg.MustRegister(m.requests, m.duration, m.nodeRequests, m.nodeDuration,
+		m.dialFailures, m.ringNodes, m.ringOwnership, m.loadSkew, m.partialWrites, m.rejected, m.concurrencyLimit, m.inflight)
+	return m
+}
+
+// observeNode records one call to node. Unavailable means the node could not
+// be reached at all, so it also counts as a dial failure.
+func (m *gatewayMetrics) observeNode(node, op string, start time.Time, err error) {
+	code := status.Code(err)
+	m.nodeRequests.WithLabelValues(node, op, code.String()).Inc()
+	m.nodeDuration.WithLabelValues(node, op).Observe(time.Since(start).Seconds())
+	if code == codes.Unavailable {
+		m.dialFailures.WithLabelValues(node).Inc()
+	}
+}
+
+func (g *Gateway) updateRingMetrics() {
+	share := g.ring.Ownership()
+	g.metrics.ringNodes.Set(float64(len(share)))
+	g.metrics.ringOwnership.Reset()
+	for n, s := range share {
+		g.metrics.ringOwnership.WithLabelValues(n).Set(s)
+	}
+}
+
+// instrument counts requests and latency for route and wraps it in a span,
+// continuing any trace passed in the request headers. The X-Request-ID
+// header is kept, or generated, and echoed back.
+func (g *Gateway) instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(logging.RequestIDHeader)
+		if id == "" {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(logging.RequestIDHeader, id)
+		ctx := logging.WithRequestID(r.Context(), id)
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.route", route)))
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(otelcodes.Error, http.StatusText(rec.status))
+		}
+		g.metrics.requests.WithLabelValues(route, strconv.Itoa(rec.status)).Inc()
+		g.metrics.duration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		slog.DebugContext(ctx, "request served", "method", r.Method, "route", route,
+			"status", rec.status, "duration_ms", time.Since(start).Milliseconds())
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,240 @@
+package gateway
+
+import (
+	_ "embed"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"shardo/internal/tracing"
+	"shardo/proto/cachepb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keysRoute is the /v2 resource for a single key. The wildcard takes the
+// rest of the path, so keys may contain slashes.
+const keysRoute = "/v2/keys/{key...}"
+
+// defaultContentType is stored for PUTs without a Content-Type and served
+// for values written through v1.
+const defaultContentType = "application/octet-stream"
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError answers with status and, under /v2/, a JSON body carrying the
+// machine readable code. v1 routes keep their plain text errors.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if !strings.HasPrefix(r.URL.Path, "/v2/") {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(map[string]apiError{"error": {Code: code, Message: message}}); err != nil {
+		slog.WarnContext(r.Context(), "error encoding error response", "err", err)
+	}
+}
+
+// nodeError reports a failed node call: 412 when an If-Match condition
+// failed, 400 or 403 when the node refused the namespace, 503 when no node
+// could be reached, 504 when the node did not answer within the request
+// timeout and 502 for anything else the node returned.
+func nodeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch status.Code(err) {
+	case codes.FailedPrecondition:
+		writeError(w, r, http.StatusPreconditionFailed, "precondition_failed", "If-Match does not match the current value")
+	case codes.InvalidArgument:
+		writeError(w, r, http.StatusBadRequest, "invalid_namespace", "invalid namespace")
+	case codes.PermissionDenied:
+		writeError(w, r, http.StatusForbidden, "namespace_not_allowed", "namespace is not served by the nodes")
+	case codes.Unavailable:
+		writeError(w, r, http.StatusServiceUnavailable, "unavailable", "no node for the key is reachable")
+	case codes.DeadlineExceeded:
+		writeError(w, r, http.StatusGatewayTimeout, "timeout", "node did not answer in time")
+	default:
+		writeError(w, r, http.StatusBadGateway, "node_error", "node failed")
+	}
+}
+
+func pathKey(r *http.Request) string {
+	return r.PathValue("key")
+}
+
+// requireKey answers 400 for /v2/keys/ without a key.
+func requireKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := pathKey(r)
+	if key == "" {
+		writeError(w, r, http.StatusBadRequest, "invalid_key", "missing key")
+	}
+	return key, key != ""
+}
+
+func (g *Gateway) handleKeyGet(w http.ResponseWriter, r *http.Request) {
+	key, ok := requireKey(w, r)
+	if !ok {
+		return
+	}
+	resp, err := g.fetch(r.Context(), namespace(r), key)
+	if err != nil {
+		nodeError(w, r, err)
+		return
+	}
+	if !resp.Found {
+		writeError(w, r, http.StatusNotFound, "not_found", "key not found")
+		return
+	}
+	// Shared caches may keep the value until the key expires, never longer.
+	w.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(resp.TtlMs/1000, 10))
+	if resp.Etag != "" {
+		w.Header().Set("ETag", quoteETag(resp.Etag))
+		if slices.ContainsFunc(parseETags(r.Header.Values("If-None-Match"), true), func(t string) bool {
+			return t == "*" || t == resp.Etag
+		}) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	contentType := resp.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(resp.Value); err != nil {
+		slog.WarnContext(r.Context(), "error writing response", tracing.LogKeyHash(key), "err", err)
+	}
+}
+
+// handleKeyPut stores the body with the request's Content-Type. Unlike
+// /set, the ttl parameter is required.
+func (g *Gateway) handleKeyPut(w http.ResponseWriter, r *http.Request) {
+	key, ok := requireKey(w, r)
+	if !ok {
+		return
+	}
+	ifMatch, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	ttl, err := strconv.ParseInt(r.URL.Query().Get("ttl"), 10, 64)
+	if err != nil || ttl <= 0 {
+		writeError(w, r, http.StatusBadRequest, "invalid_ttl", "ttl must be a positive number of seconds")
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultContentType
+	} else if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_content_type", "invalid Content-Type")
+		return
+	}
+	value, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_body", "invalid body")
+		return
+	}
+	resp, err := g.store(r.Context(), &cachepb.SetRequest{
+		Key:         key,
+		Value:       value,
+		Ttl:         ttl,
+		Namespace:   namespace(r),
+		ContentType: contentType,
+		IfMatch:     ifMatch,
+	})
+	if err = reportPartial(w, err); err != nil {
+		nodeError(w, r, err)
+		return
+	}
+	if resp.Etag != "" {
+		w.Header().Set("ETag", quoteETag(resp.Etag))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (g *Gateway) handleKeyDelete(w http.ResponseWriter, r *http.Request) {
+	key, ok := requireKey(w, r)
+	if !ok {
+		return
+	}
+	ifMatch, ok := requireIfMatch(w, r)
+	if !ok {
+		return
+	}
+	if err := reportPartial(w, g.remove(r.Context(), namespace(r), key, ifMatch)); err != nil {
+		nodeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireIfMatch returns the strong tags of the If-Match header, nil when
+// there is none. A header no tag can match is answered with 412 right away,
+// since an empty list would reach the nodes as no condition at all.
+func requireIfMatch(w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	header := r.Header.Values("If-Match")
+	if len(header) == 0 {
+		return nil, true
+	}
+	tags := parseETags(header, false)
+	if len(tags) == 0 {
+		writeError(w, r, http.StatusPreconditionFailed, "precondition_failed", "If-Match does not match the current value")
+	}
+	return tags, len(tags) > 0
+}
+
+// parseETags returns the opaque tags listed in If-Match or If-None-Match
+// header values, with "*" kept as is. Weak tags are dropped unless weak is
+// set: If-Match uses the strong comparison, which they never pass.
+func parseETags(header []string, weak bool) []string {
+	var tags []string
+	for _, tag := range strings.Split(strings.Join(header, ","), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			tags = append(tags, tag)
+			continue
+		}
+		if rest, ok := strings.CutPrefix(tag, "W/"); ok {
+			if !weak {
+				continue
+			}
+			tag = rest
+		}
+		if len(tag) >= 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+			tags = append(tags, tag[1:len(tag)-1])
+		}
+	}
+	return tags
+}
+
+func quoteETag(tag string) string {
+	return `"` + tag + `"`
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+	writeError(w, r, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+}
+
+func routeNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "not_found", "no such route")
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	if _, err := w.Write(openAPISpec); err != nil {
+		slog.WarnContext(r.Context(), "error writing OpenAPI spec", "err", err)
+	}
+}
@@ -0,0 +1,68 @@
+package grpcserver
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"shardo/pkg/cache"
+)
+
+// NamespaceGuard checks the namespace named by every request before it
+// reaches the cache, so a caller cannot create namespaces, and their metric
+// series, that the gateway would have refused.
+type NamespaceGuard struct {
+	// Allow reports whether a namespace may be used. Nil allows every valid
+	// name; the default namespace is always allowed.
+	Allow func(name string) bool
+}
+
+type namespaced interface {
+	GetNamespace() string
+}
+
+func (g NamespaceGuard) check(req any) error {
+	r, ok := req.(namespaced)
+	if !ok || r.GetNamespace() == "" || r.GetNamespace() == cache.DefaultNamespace {
+		return nil
+	}
+	name := r.GetNamespace()
+	if !cache.ValidNamespace(name) {
+		return status.Errorf(codes.InvalidArgument, "invalid namespace %q", name)
+	}
+	if g.Allow != nil && !g.Allow(name) {
+		return status.Errorf(codes.PermissionDenied, "namespace %q is not configured on this node", name)
+	}
+	return nil
+}
+
+func (g NamespaceGuard) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := g.check(req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor checks the request of server streams, which the
+// handler only reads through RecvMsg.
+func (g NamespaceGuard) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &guardedStream{ServerStream: ss, guard: g})
+	}
+}
+
+type guardedStream struct {
+	grpc.ServerStream
+	guard NamespaceGuard
+}
+
+func (s *guardedStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.guard.check(m)
+}
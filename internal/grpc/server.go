@@ -2,16 +2,28 @@ package grpcserver
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"math"
 	"net"
 	"net/http"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
+	"shardo/internal/auth"
+	"shardo/internal/logging"
+	"shardo/internal/tlsutil"
+	"shardo/internal/tracing"
 	"shardo/pkg/cache"
 	"shardo/proto/cachepb"
 )
@@ -23,8 +35,26 @@ type CacheServiceServer interface {
 	Metrics(context.Context, *MetricsRequest) (*MetricsResponse, error)
 }
 
+const (
+	scanBatchSize   = 1000
+	watchBufferSize = 1024
+)
+
+var tracer = otel.Tracer("shardo/node")
+
+// errETagMismatch answers writes whose if_match the current entry fails.
+var errETagMismatch = status.Error(codes.FailedPrecondition, "etag does not match")
+
+var watchEventTypes = map[cache.EventType]cachepb.EventType{
+	cache.EventSet:    cachepb.EventType_EVENT_TYPE_SET,
+	cache.EventDelete: cachepb.EventType_EVENT_TYPE_DELETE,
+	cache.EventExpire: cachepb.EventType_EVENT_TYPE_EXPIRE,
+	cache.EventEvict:  cachepb.EventType_EVENT_TYPE_EVICT,
+}
+
 type server struct {
 	cache *cache.Cache
+	done  chan struct{} // closed on shutdown
 	cachepb.UnimplementedCacheServiceServer
 }
 
@@ -63,15 +93,42 @@ func safeInt32(val int) int32 {
 }
 
 func (s *server) Get(ctx context.Context, req *cachepb.GetRequest) (*cachepb.GetResponse, error) {
-	val, ok := s.cache.Get(req.Key)
-	return &cachepb.GetResponse{Value: val, Found: ok}, nil
+	_, span := tracer.Start(ctx, "cache.Get", trace.WithAttributes(tracing.KeyHash(req.Key), tracing.AttrNamespace.String(req.Namespace)))
+	defer span.End()
+	it, ok := s.cache.Namespace(req.Namespace).GetItem(req.Key)
+	span.SetAttributes(tracing.AttrHit.Bool(ok), tracing.AttrValueSize.Int(len(it.Value)))
+	if !ok {
+		return &cachepb.GetResponse{}, nil
+	}
+	return &cachepb.GetResponse{
+		Value:       it.Value,
+		Found:       true,
+		ContentType: it.ContentType,
+		Etag:        cache.ETag(it.Value, it.ContentType),
+		TtlMs:       max(time.Until(it.Expires).Milliseconds(), 0),
+	}, nil
 }
 func (s *server) Set(ctx context.Context, req *cachepb.SetRequest) (*cachepb.SetResponse, error) {
-	s.cache.Set(req.Key, req.Value, time.Duration(req.Ttl)*time.Second)
-	return &cachepb.SetResponse{}, nil
+	_, span := tracer.Start(ctx, "cache.Set", trace.WithAttributes(tracing.KeyHash(req.Key), tracing.AttrNamespace.String(req.Namespace),
+		tracing.AttrValueSize.Int(len(req.Value))))
+	defer span.End()
+	ns, ttl := s.cache.Namespace(req.Namespace), time.Duration(req.Ttl)*time.Second
+	if req.IfMatch == nil {
+		ns.SetWithContentType(req.Key, req.Value, req.ContentType, ttl)
+	} else if !ns.SetIfMatch(req.Key, req.Value, req.ContentType, ttl, req.IfMatch) {
+		return nil, errETagMismatch
+	}
+	return &cachepb.SetResponse{Etag: cache.ETag(req.Value, req.ContentType)}, nil
 }
 func (s *server) Delete(ctx context.Context, req *cachepb.DeleteRequest) (*cachepb.DeleteResponse, error) {
-	s.cache.Delete(req.Key)
+	_, span := tracer.Start(ctx, "cache.Delete", trace.WithAttributes(tracing.KeyHash(req.Key), tracing.AttrNamespace.String(req.Namespace)))
+	defer span.End()
+	ns := s.cache.Namespace(req.Namespace)
+	if req.IfMatch == nil {
+		ns.Delete(req.Key)
+	} else if !ns.DeleteIfMatch(req.Key, req.IfMatch) {
+		return nil, errETagMismatch
+	}
 	return &cachepb.DeleteResponse{}, nil
 }
 func (s *server) Metrics(ctx context.Context, req *cachepb.MetricsRequest) (*cachepb.MetricsResponse, error) {
@@ -83,33 +140,213 @@ func (s *server) Metrics(ctx context.Context, req *cachepb.MetricsRequest) (*cac
 	}, nil
 }
 
-func StartGRPCServer(port string, cacheCap int) {
-	c := cache.New(cacheCap)
-	s := grpc.NewServer()
-	cachepb.RegisterCacheServiceServer(s, &server{cache: c})
+func (s *server) Exists(ctx context.Context, req *cachepb.ExistsRequest) (*cachepb.ExistsResponse, error) {
+	return &cachepb.ExistsResponse{Exists: s.cache.Namespace(req.Namespace).Exists(req.Key)}, nil
+}
+func (s *server) GetTTL(ctx context.Context, req *cachepb.GetTTLRequest) (*cachepb.GetTTLResponse, error) {
+	ttl, ok := s.cache.Namespace(req.Namespace).TTL(req.Key)
+	return &cachepb.GetTTLResponse{Found: ok, TtlMs: ttl.Milliseconds()}, nil
+}
+func (s *server) Touch(ctx context.Context, req *cachepb.TouchRequest) (*cachepb.TouchResponse, error) {
+	return &cachepb.TouchResponse{Found: s.cache.Namespace(req.Namespace).Touch(req.Key, time.Duration(req.Ttl)*time.Second)}, nil
+}
+func (s *server) Scan(req *cachepb.ScanRequest, stream cachepb.CacheService_ScanServer) error {
+	scanner := s.cache.Namespace(req.Namespace).NewScanner(req.Prefix, req.Cursor)
+	sent := 0
+	for {
+		batch := scanBatchSize
+		if req.Limit > 0 {
+			batch = min(batch, int(req.Limit)-sent)
+		}
+		items := scanner.Next(batch)
+		for _, it := range items {
+			if err := stream.Context().Err(); err != nil {
+				return err
+			}
+			resp := &cachepb.ScanResponse{Key: it.Key, TtlMs: time.Until(it.Expires).Milliseconds()}
+			if req.IncludeValues {
+				resp.Value = it.Value
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+		sent += len(items)
+		if len(items) == 0 || (req.Limit > 0 && sent >= int(req.Limit)) {
+			return nil
+		}
+	}
+}
+func (s *server) FlushAll(ctx context.Context, req *cachepb.FlushAllRequest) (*cachepb.FlushAllResponse, error) {
+	if req.Namespace != "" {
+		return &cachepb.FlushAllResponse{Removed: int64(s.cache.Namespace(req.Namespace).Flush())}, nil
+	}
+	return &cachepb.FlushAllResponse{Removed: int64(s.cache.Flush())}, nil
+}
+func (s *server) Stats(ctx context.Context, req *cachepb.StatsRequest) (*cachepb.StatsResponse, error) {
+	st := s.cache.Stats()
+	if req.Namespace != "" {
+		ns := s.cache.Namespace(req.Namespace).Stats()
+		return &cachepb.StatsResponse{
+			Hits:          ns.Hits,
+			Misses:        ns.Misses,
+			Size:          int64(ns.Size),
+			Capacity:      int64(st.Capacity),
+			Evictions:     ns.Evictions,
+			Bytes:         ns.Bytes,
+			UptimeSeconds: int64(st.Uptime.Seconds()),
+			MaxKeys:       int64(ns.Quota.MaxKeys),
+			MaxBytes:      ns.Quota.MaxBytes,
+		}, nil
+	}
+	return &cachepb.StatsResponse{
+		Hits:          st.Hits,
+		Misses:        st.Misses,
+		Size:          int64(st.Size),
+		Capacity:      int64(st.Capacity),
+		Evictions:     st.Evictions,
+		Expirations:   st.Expirations,
+		Bytes:         st.Bytes,
+		UptimeSeconds: int64(st.Uptime.Seconds()),
+	}, nil
+}
 
+// Watch streams changes to keys under req.Prefix in req.Namespace. A watcher that falls more
+// than watchBufferSize events behind is disconnected rather than allowed to
+// slow down cache writes.
+func (s *server) Watch(req *cachepb.WatchRequest, stream cachepb.CacheService_WatchServer) error {
+	events := make(chan *cachepb.WatchEvent, watchBufferSize)
+	overflow := make(chan struct{})
+	var once sync.Once
+	namespace := s.cache.Namespace(req.Namespace).Name()
+	unsubscribe := s.cache.Subscribe(func(ev cache.Event) {
+		if ev.Namespace != namespace || !strings.HasPrefix(ev.Key, req.Prefix) {
+			return
+		}
+		msg := &cachepb.WatchEvent{Type: watchEventTypes[ev.Type], Key: ev.Key, Namespace: ev.Namespace}
+		if req.IncludeValues {
+			msg.Value = ev.Value
+		}
+		select {
+		case events <- msg:
+		default:
+			once.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, "node shutting down")
+		case <-overflow:
+			return status.Error(codes.ResourceExhausted, "watcher fell behind, events were dropped")
+		case msg := <-events:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type Config struct {
+	NodeID          string
+	Port            string
+	MetricsPort     string
+	ShutdownTimeout time.Duration
+	TracesExporter  string
+	TLS             *tlsutil.Reloader // serves gRPC over TLS when set
+	Guard           *auth.NodeGuard   // restricts callers to gateways when set
+	// AllowNamespace limits the namespaces requests may use; nil allows any
+	// valid name. Invalid names are always refused.
+	AllowNamespace func(name string) bool
+}
+
+// StartGRPCServer serves c until ctx is cancelled, then drains in-flight
+// RPCs and stops the metrics server within cfg.ShutdownTimeout.
+func StartGRPCServer(ctx context.Context, c *cache.Cache, cfg Config) error {
+	shutdown, err := tracing.Setup(ctx, "shardo-node", cfg.TracesExporter)
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.Background())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	metricsSrv := &http.Server{
+		Addr:         ":" + cfg.MetricsPort,
+		Handler:      mux,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  120 * time.Second,
+	}
 	go func() {
-		mux := http.NewServeMux()
-		mux.Handle("/metrics", promhttp.Handler())
-		srv := &http.Server{
-			Addr:         ":" + os.Getenv("METRICS_PORT"),
-			Handler:      mux,
-			ReadTimeout:  5 * time.Second,
-			WriteTimeout: 10 * time.Second,
-			IdleTimeout:  120 * time.Second,
+		slog.Info("serving Prometheus metrics", "port", cfg.MetricsPort)
+		if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server error", "err", err)
 		}
-		log.Printf("Prometheus metrics on :%s/metrics", os.Getenv("METRICS_PORT"))
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("metrics server error: %v", err)
+	}()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := metricsSrv.Shutdown(ctx); err != nil {
+			slog.Warn("error stopping metrics server", "err", err)
 		}
 	}()
 
-	lis, err := net.Listen("tcp", ":"+port)
+	lis, err := net.Listen("tcp", ":"+cfg.Port)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		return fmt.Errorf("listening on %s: %w", cfg.Port, err)
 	}
-	log.Printf("gRPC cache node listening on %s", port)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	slog.Info("gRPC cache node listening", "node", cfg.NodeID, "port", cfg.Port, "tls", cfg.TLS != nil)
+	var opts []grpc.ServerOption
+	if cfg.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg.TLS.ServerConfig())))
+	}
+	if cfg.Guard != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(cfg.Guard.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(cfg.Guard.StreamServerInterceptor()))
+	}
+	namespaces := NamespaceGuard{Allow: cfg.AllowNamespace}
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(namespaces.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(namespaces.StreamServerInterceptor()))
+	return serve(ctx, lis, c, cfg.ShutdownTimeout, opts...)
+}
+
+// serve runs the cache service on lis until ctx is cancelled. It then ends
+// Watch streams and waits for other RPCs with GracefulStop, closing whatever
+// is left after timeout.
+func serve(ctx context.Context, lis net.Listener, c *cache.Cache, timeout time.Duration, opts ...grpc.ServerOption) error {
+	srv := &server{cache: c, done: make(chan struct{})}
+	s := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(logging.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(logging.StreamServerInterceptor()),
+	}, opts...)...)
+	cachepb.RegisterCacheServiceServer(s, srv)
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(lis) }()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down node", "timeout", timeout.String())
+	close(srv.done)
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		slog.Warn("graceful stop timed out, closing connections")
+		s.Stop()
 	}
+	return nil
 }
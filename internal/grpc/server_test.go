@@ -0,0 +1,448 @@
+package grpcserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"shardo/internal/auth"
+	"shardo/internal/tlsutil"
+	"shardo/internal/tlsutil/tlstest"
+	"shardo/internal/tracing"
+	"shardo/internal/tracing/tracingtest"
+	"shardo/pkg/cache"
+	"shardo/proto/cachepb"
+)
+
+func newTestClient(t *testing.T, c *cache.Cache) cachepb.CacheServiceClient {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+	cachepb.RegisterCacheServiceServer(s, &server{cache: c})
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return cachepb.NewCacheServiceClient(conn)
+}
+
+func TestScanStreamsAllPages(t *testing.T) {
+	c := cache.NewWithRegistry(5000, prometheus.NewRegistry())
+	for i := 0; i < 2500; i++ {
+		c.Set("user:"+strconv.Itoa(i), []byte("v"), time.Minute)
+	}
+	c.Set("other", []byte("v"), time.Minute)
+	client := newTestClient(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	count := func(req *cachepb.ScanRequest) (int, string) {
+		stream, err := client.Scan(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, last := 0, ""
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				return n, last
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.IncludeValues && string(resp.Value) != "v" {
+				t.Fatalf("expected value for %s", resp.Key)
+			}
+			n++
+			last = resp.Key
+		}
+	}
+	if n, _ := count(&cachepb.ScanRequest{Prefix: "user:", IncludeValues: true}); n != 2500 {
+		t.Fatalf("expected 2500 keys, got %d", n)
+	}
+	n, last := count(&cachepb.ScanRequest{Prefix: "user:", Limit: 1200})
+	if n != 1200 {
+		t.Fatalf("expected limit of 1200 keys, got %d", n)
+	}
+	if rest, _ := count(&cachepb.ScanRequest{Prefix: "user:", Cursor: last}); rest != 1300 {
+		t.Fatalf("expected 1300 keys after cursor, got %d", rest)
+	}
+}
+
+func TestStatsAndFlushAll(t *testing.T) {
+	c := cache.NewWithRegistry(10, prometheus.NewRegistry())
+	client := newTestClient(t, c)
+	ctx := context.Background()
+	if _, err := client.Set(ctx, &cachepb.SetRequest{Key: "foo", Value: []byte("bar"), Ttl: 60}); err != nil {
+		t.Fatal(err)
+	}
+	ttl, err := client.GetTTL(ctx, &cachepb.GetTTLRequest{Key: "foo"})
+	if err != nil || !ttl.Found || ttl.TtlMs <= 0 {
+		t.Fatalf("unexpected GetTTL response %v, %v", ttl, err)
+	}
+	st, err := client.Stats(ctx, &cachepb.StatsRequest{})
+	if err != nil || st.Size != 1 || st.Bytes != 6 || st.Capacity != 10 {
+		t.Fatalf("unexpected stats %v, %v", st, err)
+	}
+	flushed, err := client.FlushAll(ctx, &cachepb.FlushAllRequest{})
+	if err != nil || flushed.Removed != 1 {
+		t.Fatalf("unexpected FlushAll response %v, %v", flushed, err)
+	}
+	exists, err := client.Exists(ctx, &cachepb.ExistsRequest{Key: "foo"})
+	if err != nil || exists.Exists {
+		t.Fatalf("expected foo to be gone, got %v, %v", exists, err)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	c := cache.NewWithRegistry(10, prometheus.NewRegistry())
+	c.SetQuota("team-a", cache.Quota{MaxKeys: 5})
+	client := newTestClient(t, c)
+	ctx := context.Background()
+	for _, ns := range []string{"team-a", "team-b"} {
+		if _, err := client.Set(ctx, &cachepb.SetRequest{Key: "foo", Value: []byte(ns), Ttl: 60, Namespace: ns, ContentType: "text/plain"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := client.Get(ctx, &cachepb.GetRequest{Key: "foo", Namespace: "team-b"})
+	if err != nil || string(got.Value) != "team-b" || got.ContentType != "text/plain" {
+		t.Fatalf("expected team-b value, got %v, %v", got, err)
+	}
+	if got, _ := client.Get(ctx, &cachepb.GetRequest{Key: "foo"}); got.Found {
+		t.Fatal("expected the default namespace to be empty")
+	}
+	st, err := client.Stats(ctx, &cachepb.StatsRequest{Namespace: "team-a"})
+	if err != nil || st.Size != 1 || st.MaxKeys != 5 || st.Hits != 0 {
+		t.Fatalf("unexpected namespace stats %v, %v", st, err)
+	}
+	flushed, err := client.FlushAll(ctx, &cachepb.FlushAllRequest{Namespace: "team-a"})
+	if err != nil || flushed.Removed != 1 {
+		t.Fatalf("unexpected FlushAll response %v, %v", flushed, err)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("expected team-b to survive the flush, got %d entries", c.Len())
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	c := cache.NewWithRegistry(10, prometheus.NewRegistry())
+	client := newTestClient(t, c)
+	ctx := context.Background()
+	set, err := client.Set(ctx, &cachepb.SetRequest{Key: "k", Value: []byte("v1"), Ttl: 60, ContentType: "text/plain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := client.Get(ctx, &cachepb.GetRequest{Key: "k"})
+	if err != nil || got.Etag != set.Etag || got.TtlMs <= 59000 || got.TtlMs > 60000 {
+		t.Fatalf("expected the etag %q and a ttl near 60s, got %v, %v", set.Etag, got, err)
+	}
+	_, err = client.Set(ctx, &cachepb.SetRequest{Key: "k", Value: []byte("v2"), Ttl: 60, IfMatch: []string{"stale"}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for a stale etag, got %v", err)
+	}
+	if _, err := client.Set(ctx, &cachepb.SetRequest{Key: "k", Value: []byte("v2"), Ttl: 60, IfMatch: []string{set.Etag}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Delete(ctx, &cachepb.DeleteRequest{Key: "k", IfMatch: []string{set.Etag}})
+	if status.Code(err) != codes.FailedPrecondition || !c.Exists("k") {
+		t.Fatalf("expected delete with the old etag to fail, got %v", err)
+	}
+	if _, err := client.Delete(ctx, &cachepb.DeleteRequest{Key: "k", IfMatch: []string{"*"}}); err != nil || c.Exists("k") {
+		t.Fatalf("expected delete with * to remove the key, got %v", err)
+	}
+}
+
+func TestWatchStreamsPrefixedEvents(t *testing.T) {
+	c := cache.NewWithRegistry(10, prometheus.NewRegistry())
+	client := newTestClient(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Watch(ctx, &cachepb.WatchRequest{Prefix: "cfg:", IncludeValues: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The subscription is registered asynchronously; keep writing until the
+	// first event shows up.
+	go func() {
+		for ctx.Err() == nil {
+			c.Set("cfg:ready", []byte("1"), time.Minute)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Key == "cfg:ready" {
+			break
+		}
+	}
+	c.Set("other", []byte("x"), time.Minute)
+	c.Set("cfg:a", []byte("v"), time.Minute)
+	c.Delete("cfg:a")
+	var got []*cachepb.WatchEvent
+	for len(got) < 2 {
+		ev, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Key == "cfg:a" {
+			got = append(got, ev)
+		}
+	}
+	if got[0].Type != cachepb.EventType_EVENT_TYPE_SET || string(got[0].Value) != "v" {
+		t.Fatalf("unexpected first event %v", got[0])
+	}
+	if got[1].Type != cachepb.EventType_EVENT_TYPE_DELETE {
+		t.Fatalf("unexpected second event %v", got[1])
+	}
+}
+
+func TestTraceContextReachesNode(t *testing.T) {
+	recorder := tracingtest.Install()
+	c := cache.NewWithRegistry(10, prometheus.NewRegistry())
+	c.Set("foo", []byte("bar"), time.Minute)
+	client := newTestClient(t, c)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "gateway")
+	if _, err := client.Get(ctx, &cachepb.GetRequest{Key: "foo"}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+
+	for _, span := range recorder.Ended() {
+		if span.Name() != "cache.Get" {
+			continue
+		}
+		if span.SpanContext().TraceID() != parent.SpanContext().TraceID() {
+			t.Fatal("expected node span to join the caller's trace")
+		}
+		attrs := make(map[string]string)
+		for _, kv := range span.Attributes() {
+			attrs[string(kv.Key)] = kv.Value.Emit()
+		}
+		if attrs[string(tracing.AttrHit)] != "true" || attrs[string(tracing.AttrValueSize)] != "3" || attrs[string(tracing.AttrKeyHash)] == "" {
+			t.Fatalf("unexpected span attributes %v", attrs)
+		}
+		return
+	}
+	t.Fatal("expected a cache.Get span")
+}
+
+func TestServeDrainsOnCancel(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, lis, cache.NewWithRegistry(10, prometheus.NewRegistry()), 2*time.Second) }()
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := cachepb.NewCacheServiceClient(conn)
+	if _, err := client.Set(context.Background(), &cachepb.SetRequest{Key: "a", Value: []byte("1"), Ttl: 60}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.Watch(context.Background(), &cachepb.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected watch to end with Unavailable, got %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	caFile, certFile, keyFile := ca.WriteFiles(t, t.TempDir(), "node1")
+	nodeTLS, err := tlsutil.NewReloader(tlsutil.Files{CA: caFile, Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, lis, cache.NewWithRegistry(10, prometheus.NewRegistry()), time.Second,
+		grpc.Creds(credentials.NewTLS(nodeTLS.ServerConfig())))
+
+	_, gwCert, gwKey := ca.WriteFiles(t, t.TempDir(), "gateway")
+	cases := []struct {
+		name  string
+		files tlsutil.Files
+		want  codes.Code
+	}{
+		{"without client certificate", tlsutil.Files{CA: caFile}, codes.Unavailable},
+		{"with client certificate", tlsutil.Files{CA: caFile, Cert: gwCert, Key: gwKey}, codes.OK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := tlsutil.NewReloader(tc.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := grpc.NewClient(lis.Addr().String(),
+				grpc.WithTransportCredentials(credentials.NewTLS(r.ClientConfig("node1"))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			rctx, rcancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer rcancel()
+			_, err = cachepb.NewCacheServiceClient(conn).Set(rctx, &cachepb.SetRequest{Key: "a", Value: []byte("1"), Ttl: 60})
+			if status.Code(err) != tc.want {
+				t.Fatalf("expected %s, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestNodeGuard(t *testing.T) {
+	ca := tlstest.NewCA(t)
+	caFile, certFile, keyFile := ca.WriteFiles(t, t.TempDir(), "node1")
+	nodeTLS, err := tlsutil.NewReloader(tlsutil.Files{CA: caFile, Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := auth.NodeGuard{Secret: "s3cret", AllowedClients: []string{"gateway"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, lis, cache.NewWithRegistry(10, prometheus.NewRegistry()), time.Second,
+		grpc.Creds(credentials.NewTLS(nodeTLS.ServerConfig())),
+		grpc.ChainUnaryInterceptor(guard.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(guard.StreamServerInterceptor()))
+
+	cases := []struct {
+		name   string
+		client string
+		secret string
+		want   codes.Code
+	}{
+		{"gateway with secret", "gateway", "s3cret", codes.OK},
+		{"gateway without secret", "gateway", "", codes.Unauthenticated},
+		{"gateway with wrong secret", "gateway", "guess", codes.Unauthenticated},
+		{"other client with secret", "intruder", "s3cret", codes.PermissionDenied},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, cert, key := ca.WriteFiles(t, t.TempDir(), tc.client)
+			r, err := tlsutil.NewReloader(tlsutil.Files{CA: caFile, Cert: cert, Key: key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(r.ClientConfig("node1")))}
+			if tc.secret != "" {
+				opts = append(opts, grpc.WithPerRPCCredentials(auth.NodeSecret(tc.secret)))
+			}
+			conn, err := grpc.NewClient(lis.Addr().String(), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			client := cachepb.NewCacheServiceClient(conn)
+			rctx, rcancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer rcancel()
+			if _, err := client.FlushAll(rctx, &cachepb.FlushAllRequest{}); status.Code(err) != tc.want {
+				t.Fatalf("expected %s from FlushAll, got %v", tc.want, err)
+			}
+			stream, err := client.Scan(rctx, &cachepb.ScanRequest{})
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			if err == io.EOF {
+				err = nil
+			}
+			if status.Code(err) != tc.want {
+				t.Fatalf("expected %s from Scan, got %v", tc.want, err)
+			}
+		})
+	}
+}
+
+func TestNamespaceGuard(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewWithRegistry(10, prometheus.NewRegistry())
+	guard := NamespaceGuard{Allow: func(name string) bool { return name == "team-a" }}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serve(ctx, lis, c, time.Second,
+		grpc.ChainUnaryInterceptor(guard.UnaryServerInterceptor()),
+		grpc.ChainStreamInterceptor(guard.StreamServerInterceptor()))
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := cachepb.NewCacheServiceClient(conn)
+
+	cases := []struct {
+		namespace string
+		want      codes.Code
+	}{
+		{"", codes.OK},
+		{cache.DefaultNamespace, codes.OK},
+		{"team-a", codes.OK},
+		{"team-b", codes.PermissionDenied},
+		{"no/slashes", codes.InvalidArgument},
+		{strings.Repeat("x", 65), codes.InvalidArgument},
+	}
+	for _, tc := range cases {
+		rctx, rcancel := context.WithTimeout(ctx, 2*time.Second)
+		_, err := client.Set(rctx, &cachepb.SetRequest{Key: "k", Value: []byte("v"), Ttl: 60, Namespace: tc.namespace})
+		if status.Code(err) != tc.want {
+			t.Fatalf("%q: expected %s from Set, got %v", tc.namespace, tc.want, err)
+		}
+		stream, err := client.Watch(rctx, &cachepb.WatchRequest{Namespace: tc.namespace})
+		if err == nil && tc.want != codes.OK {
+			_, err = stream.Recv()
+		}
+		if tc.want != codes.OK && status.Code(err) != tc.want {
+			t.Fatalf("%q: expected %s from Watch, got %v", tc.namespace, tc.want, err)
+		}
+		rcancel()
+	}
+	if got := c.Namespaces(); !slices.Equal(got, []string{cache.DefaultNamespace, "team-a"}) {
+		t.Fatalf("expected refused namespaces not to be created, got %v", got)
+	}
+}
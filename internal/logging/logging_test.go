@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRequestIDFlowsThroughGRPC(t *testing.T) {
+	var buf bytes.Buffer
+	if err := setup(&buf, "test", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))) })
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	var sent metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		sent, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	if err := UnaryClientInterceptor()(ctx, "/cache.CacheService/Get", nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+
+	var seen string
+	handler := func(ctx context.Context, req any) (any, error) {
+		seen = RequestID(ctx)
+		return nil, nil
+	}
+	serverCtx := metadata.NewIncomingContext(context.Background(), sent)
+	info := &grpc.UnaryServerInfo{FullMethod: "/cache.CacheService/Get"}
+	if _, err := UnaryServerInterceptor()(serverCtx, nil, info, handler); err != nil {
+		t.Fatal(err)
+	}
+	if seen != "req-1" {
+		t.Fatalf("expected request id req-1 on the server, got %q", seen)
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %v", buf.String(), err)
+	}
+	if record["request_id"] != "req-1" || record["service"] != "test" || record["method"] != info.FullMethod {
+		t.Fatalf("unexpected log record %v", record)
+	}
+}
+
+func TestSetupRejectsUnknownLevel(t *testing.T) {
+	if err := setup(&bytes.Buffer{}, "test", "loud"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+}
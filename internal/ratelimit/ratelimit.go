@@ -0,0 +1,174 @@
+// Package ratelimit keeps one client from saturating the gateway: a token
+// bucket per client and a cap on requests in flight that adapts to latency.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// sweepInterval is how often idle buckets are looked for.
+const sweepInterval = time.Minute
+
+// Limiter keeps a token bucket per client. Buckets idle long enough to have
+// refilled are dropped, so a client that comes back starts with a full one.
+type Limiter struct {
+	rate  rate.Limit
+	burst int
+	idle  time.Duration
+	now   func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+// NewLimiter allows each client perSecond requests on average and bursts of
+// burst. A burst below 1 defaults to one second's worth of requests.
+func NewLimiter(perSecond float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = max(1, int(math.Ceil(perSecond)))
+	}
+	refill := time.Duration(float64(burst) / perSecond * float64(time.Second))
+	return &Limiter{
+		rate:    rate.Limit(perSecond),
+		burst:   burst,
+		idle:    max(refill, sweepInterval),
+		now:     time.Now,
+		clients: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from client's bucket. When the bucket is empty it
+// returns false and how long until the next token.
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{lim: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[client] = b
+	}
+	b.seen = now
+	r := b.lim.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// Wait returns how long until client's bucket has a token, without taking
+// one. It is zero when a token is available now.
+func (l *Limiter) Wait(client string) time.Duration {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.clients[client]
+	if !ok {
+		return 0
+	}
+	r := b.lim.ReserveN(now, 1)
+	defer r.CancelAt(now)
+	return r.DelayFrom(now)
+}
+
+// Clients returns how many buckets are being tracked.
+func (l *Limiter) Clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.clients)
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, b := range l.clients {
+		if now.Sub(b.seen) > l.idle {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// Shedder caps the requests in flight. Without a target latency the cap is
+// fixed at max. With one, the cap adapts once per window of completed
+// requests: it shrinks by a tenth, down to min, when the window's average
+// latency is over the target, and grows by one, up to max, when it is under
+// the target and the cap was reached.
+type Shedder struct {
+	min, max int
+	target   time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	limit    int
+	inflight int
+	// The current window: completions, their total latency and whether the
+	// cap was reached during it.
+	done      int
+	latency   time.Duration
+	saturated bool
+}
+
+func NewShedder(minimum, maximum int, target time.Duration) *Shedder {
+	minimum = min(max(minimum, 1), maximum)
+	return &Shedder{min: minimum, max: maximum, target: target, now: time.Now, limit: maximum}
+}
+
+// Acquire takes a slot, returning false when none is free. release must be
+// called once the request is done.
+func (s *Shedder) Acquire() (release func(), ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight >= s.limit {
+		s.saturated = true
+		return nil, false
+	}
+	s.inflight++
+	if s.inflight == s.limit {
+		s.saturated = true
+	}
+	start := s.now()
+	var once sync.Once
+	return func() { once.Do(func() { s.release(s.now().Sub(start)) }) }, true
+}
+
+func (s *Shedder) release(took time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	if s.target <= 0 {
+		return
+	}
+	s.done++
+	s.latency += took
+	if s.done < s.limit {
+		return
+	}
+	switch avg := s.latency / time.Duration(s.done); {
+	case avg > s.target:
+		s.limit = max(s.min, s.limit-max(1, s.limit/10))
+	case s.saturated:
+		s.limit = min(s.max, s.limit+1)
+	}
+	s.done, s.latency, s.saturated = 0, 0, false
+}
+
+// Limit returns the current cap and the requests in flight.
+func (s *Shedder) Limit() (limit, inflight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limit, s.inflight
+}
@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	l := NewLimiter(2, 3)
+	l.now = clock.now
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("expected request %d within the burst to pass", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected a rejection with 500ms to wait, got %v, %v", ok, wait)
+	}
+	if wait := l.Wait("a"); wait != 500*time.Millisecond {
+		t.Fatalf("expected Wait to report 500ms, got %v", wait)
+	}
+	if wait := l.Wait("b"); wait != 0 {
+		t.Fatalf("expected no wait for an unseen client, got %v", wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("expected another client to have its own bucket")
+	}
+	clock.advance(500 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("expected a token after waiting")
+	}
+
+	clock.advance(2 * sweepInterval)
+	l.Allow("c")
+	if n := l.Clients(); n != 1 {
+		t.Fatalf("expected idle buckets to be dropped, got %d clients", n)
+	}
+}
+
+func TestShedderFixedLimit(t *testing.T) {
+	s := NewShedder(0, 2, 0)
+	r1, ok1 := s.Acquire()
+	_, ok2 := s.Acquire()
+	if _, ok := s.Acquire(); !ok1 || !ok2 || ok {
+		t.Fatal("expected the third request to be shed")
+	}
+	r1()
+	r1()
+	if limit, inflight := s.Limit(); limit != 2 || inflight != 1 {
+		t.Fatalf("expected limit 2 with 1 in flight, got %d, %d", limit, inflight)
+	}
+	if _, ok := s.Acquire(); !ok {
+		t.Fatal("expected a released slot to be reusable")
+	}
+}
+
+func TestShedderAdapts(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+	s := NewShedder(5, 20, 100*time.Millisecond)
+	s.now = clock.now
+	window := func(latency time.Duration, n int) {
+		releases := make([]func(), 0, n)
+		for i := 0; i < n; i++ {
+			if release, ok := s.Acquire(); ok {
+				releases = append(releases, release)
+			}
+		}
+		clock.advance(latency)
+		for _, release := range releases {
+			release()
+		}
+	}
+
+	window(time.Second, 20)
+	if limit, _ := s.Limit(); limit != 18 {
+		t.Fatalf("expected a slow window to shrink the limit to 18, got %d", limit)
+	}
+	for i := 0; i < 30; i++ {
+		window(time.Second, 20)
+	}
+	if limit, _ := s.Limit(); limit != 5 {
+		t.Fatalf("expected the limit to stop at the minimum, got %d", limit)
+	}
+	window(time.Millisecond, 5)
+	if limit, _ := s.Limit(); limit != 6 {
+		t.Fatalf("expected a fast saturated window to grow the limit, got %d", limit)
+	}
+	window(time.Millisecond, 2)
+	window(time.Millisecond, 4)
+	if limit, _ := s.Limit(); limit != 6 {
+		t.Fatalf("expected an unsaturated window to keep the limit, got %d", limit)
+	}
+}
@@ -0,0 +1,198 @@
+// Package tlsutil loads TLS certificates from PEM files and reloads them when
+// the files change, so certificates can be rotated without a restart.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkInterval limits how often the files are checked for changes.
+var checkInterval = time.Second
+
+// Files names PEM files. CA verifies the peer: client certificates on a
+// server, the server certificate on a client. Cert and Key are our own
+// certificate, required on servers and for mutual TLS on clients.
+type Files struct {
+	CA   string
+	Cert string
+	Key  string
+}
+
+// Reloader holds the certificate and CA pool read from Files. They are
+// re-read when a file's modification time changes; a failed reload is logged
+// and the previous certificates are kept.
+type Reloader struct {
+	files Files
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+	checked time.Time
+}
+
+func NewReloader(files Files) (*Reloader, error) {
+	if (files.Cert == "") != (files.Key == "") {
+		return nil, errors.New("tlsutil: cert and key must be set together")
+	}
+	r := &Reloader{files: files}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the files whether or not they changed.
+func (r *Reloader) Reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	var cert *tls.Certificate
+	if r.files.Cert != "" {
+		c, err := tls.LoadX509KeyPair(r.files.Cert, r.files.Key)
+		if err != nil {
+			return fmt.Errorf("tlsutil: loading %s: %w", r.files.Cert, err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.files.CA != "" {
+		data, err := os.ReadFile(r.files.CA)
+		if err != nil {
+			return fmt.Errorf("tlsutil: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("tlsutil: no certificates found in %s", r.files.CA)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.pool = cert, pool
+	r.modTime, r.checked = modTime, time.Now()
+	return nil
+}
+
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.files.CA, r.files.Cert, r.files.Key} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("tlsutil: %w", err)
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// current returns the certificate and CA pool, reloading them first if the
+// files changed since the last check.
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	cert, pool, modTime := r.cert, r.pool, r.modTime
+	if time.Since(r.checked) < checkInterval {
+		r.mu.Unlock()
+		return cert, pool
+	}
+	r.checked = time.Now()
+	r.mu.Unlock()
+
+	latest, err := r.latestModTime()
+	if err == nil && latest.Equal(modTime) {
+		return cert, pool
+	}
+	if err == nil {
+		err = r.Reload()
+	}
+	if err != nil {
+		slog.Warn("reloading TLS certificates failed, keeping the current ones", "err", err)
+		return cert, pool
+	}
+	slog.Info("reloaded TLS certificates", "cert", r.files.Cert, "ca", r.files.CA)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.pool
+}
+
+// ServerConfig serves the current certificate. With a CA set, clients must
+// present a certificate it signed.
+func (r *Reloader) ServerConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			if cert == nil {
+				return nil, errors.New("tlsutil: no server certificate configured")
+			}
+			return cert, nil
+		},
+	}
+	if r.files.CA != "" {
+		// The pool can change, so verify by hand instead of fixing ClientCAs.
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			_, pool := r.current()
+			return verifyClient(raw, pool)
+		}
+	}
+	return cfg
+}
+
+// ClientConfig trusts the current CA pool, or the system roots without a
+// CA, and presents the current certificate when one is set. The pool is
+// taken when ClientConfig is called, so call it for each new connection.
+// serverName overrides the name checked in the server certificate.
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	cert, pool := r.current()
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: serverName,
+	}
+	if cert != nil {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	return cfg
+}
+
+func verifyClient(raw [][]byte, pool *x509.CertPool) error {
+	certs := make([]*x509.Certificate, len(raw))
+	for i, der := range raw {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("tlsutil: parsing client certificate: %w", err)
+		}
+		certs[i] = c
+	}
+	if len(certs) == 0 {
+		return errors.New("tlsutil: no client certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, c := range certs[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("tlsutil: verifying client certificate: %w", err)
+	}
+	return nil
+}
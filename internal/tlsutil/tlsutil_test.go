@@ -0,0 +1,134 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"shardo/internal/tlsutil/tlstest"
+)
+
+// handshake runs a TLS handshake over loopback and returns the serial of the
+// certificate the server presented.
+func handshake(t *testing.T, server, client *tls.Config) (string, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		errc <- tls.Server(conn, server).Handshake()
+	}()
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if serr := <-errc; err == nil {
+		err = serr
+	}
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.String(), nil
+}
+
+func TestReloaderPicksUpRotatedCertificate(t *testing.T) {
+	defer func(d time.Duration) { checkInterval = d }(checkInterval)
+	checkInterval = 0
+
+	ca := tlstest.NewCA(t)
+	caFile, certFile, keyFile := ca.WriteFiles(t, t.TempDir(), "node1")
+	r, err := NewReloader(Files{Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewReloader(Files{CA: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := handshake(t, r.ServerConfig(), client.ClientConfig("node1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM := ca.Issue(t, "node1")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(keyFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	second, err := handshake(t, r.ServerConfig(), client.ClientConfig("node1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("expected the rotated certificate to be served")
+	}
+
+	// A broken file keeps the last good certificate.
+	if err := os.WriteFile(certFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(certFile, later, later); err != nil {
+		t.Fatal(err)
+	}
+	third, err := handshake(t, r.ServerConfig(), client.ClientConfig("node1"))
+	if err != nil || third != second {
+		t.Fatalf("expected the previous certificate after a bad reload, got %s, %v", third, err)
+	}
+}
+
+func TestServerConfigRequiresClientCertificate(t *testing.T) {
+	ca, other := tlstest.NewCA(t), tlstest.NewCA(t)
+	caFile, certFile, keyFile := ca.WriteFiles(t, t.TempDir(), "127.0.0.1")
+	server, err := NewReloader(Files{CA: caFile, Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientCert, clientKey := ca.WriteFiles(t, t.TempDir(), "gateway")
+	_, strangerCert, strangerKey := other.WriteFiles(t, t.TempDir(), "gateway")
+
+	cases := []struct {
+		name    string
+		files   Files
+		wantErr bool
+	}{
+		{"no certificate", Files{CA: caFile}, true},
+		{"certificate from another CA", Files{CA: caFile, Cert: strangerCert, Key: strangerKey}, true},
+		{"trusted certificate", Files{CA: caFile, Cert: clientCert, Key: clientKey}, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := NewReloader(tc.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = handshake(t, server.ServerConfig(), client.ClientConfig(""))
+			if tc.wantErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewReloaderRejectsHalfAKeyPair(t *testing.T) {
+	if _, err := NewReloader(Files{Cert: "cert.pem"}); err == nil {
+		t.Fatal("expected an error without a key")
+	}
+	if _, err := NewReloader(Files{CA: "missing.pem"}); err == nil {
+		t.Fatal("expected an error for a missing CA file")
+	}
+}
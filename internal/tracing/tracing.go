@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	AttrKeyHash   = attribute.Key("shardo.key_hash")
+	AttrNode      = attribute.Key("shardo.node")
+	AttrHit       = attribute.Key("shardo.hit")
+	AttrValueSize = attribute.Key("shardo.value_size")
+	AttrPrincipal = attribute.Key("shardo.principal")
+	AttrNamespace = attribute.Key("shardo.namespace")
+)
+
+// Setup installs the global tracer provider and W3C propagators for service.
+// exporter is "otlp" (configured through the standard OTEL_EXPORTER_OTLP_*
+// variables), "stdout" or "none"/"" to disable tracing. The returned func
+// flushes pending spans.
+func Setup(ctx context.Context, service, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))),
+	}
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err := otlptracegrpc.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("tracing: creating otlp exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case "stdout", "console":
+		// Printed synchronously so spans show up while debugging locally.
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("tracing: creating stdout exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithSyncer(exp))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", exporter)
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// KeyHash identifies a key in spans without exporting the key itself.
+func KeyHash(key string) attribute.KeyValue {
+	return AttrKeyHash.String(hashKey(key))
+}
+
+// LogKeyHash is KeyHash for log records, so logs and spans of one key can be
+// matched up.
+func LogKeyHash(key string) slog.Attr {
+	return slog.String("key_hash", hashKey(key))
+}
+
+func hashKey(key string) string {
+	return strconv.FormatUint(xxhash.Sum64String(key), 16)
+}
@@ -0,0 +1,28 @@
+// Package tracingtest records spans for tests.
+package tracingtest
+
+import (
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	recorder = tracetest.NewSpanRecorder()
+	once     sync.Once
+)
+
+// Install sets the global tracer provider once per test binary, since otel
+// keeps delegating to the first provider it is given, and returns its
+// recorder emptied of earlier tests' spans.
+func Install() *tracetest.SpanRecorder {
+	once.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	recorder.Reset()
+	return recorder
+}
@@ -9,141 +9,543 @@ import (
 )
 
 type entry struct {
-	key     string
-	value   []byte
-	expires time.Time
+	ns          *namespace
+	key         string
+	value       []byte
+	contentType string
+	expires     time.Time
+	size        int64
+	used        uint64
 }
 
 type Cache struct {
 	capacity int
-	items    map[string]*list.Element
-	ll       *list.List
-	lock     sync.Mutex
+	spaces   map[string]*namespace
+	size     int
+	// clock is bumped on every access and stamped on the entry, so the
+	// least recently used entries of different namespaces can be compared.
+	clock uint64
+	lock  sync.Mutex
 
 	hits       int32
 	misses     int32
 	ttlExpired int32
+	evictions  int64
+	bytes      int64
+	created    time.Time
 
 	hitsMetric       prometheus.Counter
 	missesMetric     prometheus.Counter
 	ttlExpiredMetric prometheus.Counter
 	sizeMetric       prometheus.Gauge
+	evictionsMetric  *prometheus.CounterVec
 
-	registry prometheus.Registerer
+	nsEntriesMetric   *prometheus.GaugeVec
+	nsBytesMetric     *prometheus.GaugeVec
+	nsHitsMetric      *prometheus.CounterVec
+	nsMissesMetric    *prometheus.CounterVec
+	nsEvictionsMetric *prometheus.CounterVec
+
+	registry    prometheus.Registerer
+	namespace   string
+	subsystem   string
+	constLabels prometheus.Labels
+
+	subscribers      []subscriber
+	nextSubID        int
+	pending          []Event
+	evictHandlers    []func(key string, value []byte, reason EvictReason)
+	pendingEvictions []eviction
+	// queue holds the notifications of committed changes, oldest first,
+	// until the goroutine delivering (if delivering is set) gets to them.
+	queue      []notification
+	delivering bool
 }
 
 type cacheItem struct {
 	entry *entry
 }
 
-func NewWithRegistry(capacity int, reg prometheus.Registerer) *Cache {
+type Item struct {
+	Key         string
+	Value       []byte
+	ContentType string // as given to SetWithContentType, "" otherwise
+	Expires     time.Time
+}
+
+type Stats struct {
+	Hits        int64
+	Misses      int64
+	Size        int
+	Capacity    int
+	Evictions   int64
+	Expirations int64
+	Bytes       int64
+	Uptime      time.Duration
+}
+
+type Option func(*Cache)
+
+// WithRegistry registers the cache metrics on reg instead of the default
+// registerer. A nil reg disables registration.
+func WithRegistry(reg prometheus.Registerer) Option {
+	return func(c *Cache) {
+		c.registry = reg
+	}
+}
+
+// WithoutMetrics keeps the metrics out of every registry.
+func WithoutMetrics() Option {
+	return WithRegistry(nil)
+}
+
+// WithNamespace prefixes metric names, e.g. "shardo" gives
+// shardo_cache_hits_total.
+func WithNamespace(namespace string) Option {
+	return func(c *Cache) {
+		c.namespace = namespace
+	}
+}
+
+// WithSubsystem replaces the "cache" part of the metric names.
+func WithSubsystem(subsystem string) Option {
+	return func(c *Cache) {
+		c.subsystem = subsystem
+	}
+}
+
+// WithConstLabels attaches labels such as a node id or cache name to every
+// metric, so several caches can share a registry.
+func WithConstLabels(labels prometheus.Labels) Option {
+	return func(c *Cache) {
+		c.constLabels = labels
+	}
+}
+
+func NewWithOptions(capacity int, opts ...Option) *Cache {
 	c := &Cache{
-		capacity: capacity,
-		items:    make(map[string]*list.Element),
-		ll:       list.New(),
-		registry: reg,
+		capacity:  capacity,
+		spaces:    make(map[string]*namespace),
+		registry:  prometheus.DefaultRegisterer,
+		subsystem: "cache",
+		created:   time.Now(),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
 	c.initMetrics()
+	c.space(DefaultNamespace, true)
 	return c
 }
 
+func NewWithRegistry(capacity int, reg prometheus.Registerer) *Cache {
+	return NewWithOptions(capacity, WithRegistry(reg))
+}
+
 func New(capacity int) *Cache {
-	return NewWithRegistry(capacity, prometheus.DefaultRegisterer)
+	return NewWithOptions(capacity)
 }
 
 func (c *Cache) initMetrics() {
 	c.hitsMetric = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "cache_hits_total",
-		Help: "Total cache hits",
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "hits_total",
+		Help:        "Total cache hits",
+		ConstLabels: c.constLabels,
 	})
 	c.missesMetric = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "cache_misses_total",
-		Help: "Total cache misses",
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "misses_total",
+		Help:        "Total cache misses",
+		ConstLabels: c.constLabels,
 	})
 	c.ttlExpiredMetric = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "cache_ttl_expired_total",
-		Help: "Total TTL expired",
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "ttl_expired_total",
+		Help:        "Total TTL expired",
+		ConstLabels: c.constLabels,
 	})
 	c.sizeMetric = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "cache_size",
-		Help: "Current cache size",
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "size",
+		Help:        "Current cache size",
+		ConstLabels: c.constLabels,
 	})
-	c.registry.MustRegister(c.hitsMetric, c.missesMetric, c.ttlExpiredMetric, c.sizeMetric)
+	c.evictionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "evictions_total",
+		Help:        "Total entries removed or overwritten, by reason",
+		ConstLabels: c.constLabels,
+	}, []string{"reason"})
+	c.nsEntriesMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "namespace_entries",
+		Help:        "Current entries, by namespace",
+		ConstLabels: c.constLabels,
+	}, []string{"namespace"})
+	c.nsBytesMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "namespace_bytes",
+		Help:        "Current bytes held, by namespace",
+		ConstLabels: c.constLabels,
+	}, []string{"namespace"})
+	c.nsHitsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "namespace_hits_total",
+		Help:        "Total cache hits, by namespace",
+		ConstLabels: c.constLabels,
+	}, []string{"namespace"})
+	c.nsMissesMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "namespace_misses_total",
+		Help:        "Total cache misses, by namespace",
+		ConstLabels: c.constLabels,
+	}, []string{"namespace"})
+	c.nsEvictionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   c.namespace,
+		Subsystem:   c.subsystem,
+		Name:        "namespace_evictions_total",
+		Help:        "Total entries removed or overwritten, by namespace and reason",
+		ConstLabels: c.constLabels,
+	}, []string{"namespace", "reason"})
+	if c.registry != nil {
+		c.registry.MustRegister(c.hitsMetric, c.missesMetric, c.ttlExpiredMetric, c.sizeMetric, c.evictionsMetric,
+			c.nsEntriesMetric, c.nsBytesMetric, c.nsHitsMetric, c.nsMissesMetric, c.nsEvictionsMetric)
+	}
 }
 
 func (c *Cache) Set(key string, value []byte, ttl time.Duration) {
+	c.set(DefaultNamespace, key, value, "", ttl, int64(len(key)+len(value)), nil)
+}
+
+// set stores value and its content type under key in namespace name,
+// accounting size bytes for it in Stats.Bytes. With a non-nil ifMatch
+// nothing is stored, and set returns false, unless the key holds a live
+// entry matching one of the tags (see matches).
+func (c *Cache) set(name, key string, value []byte, contentType string, ttl time.Duration, size int64, ifMatch []string) bool {
 	c.lock.Lock()
-	defer c.lock.Unlock()
-	if ele, ok := c.items[key]; ok {
+	defer c.unlockAndNotify()
+	if ifMatch != nil && !c.matches(c.lookup(name, key), ifMatch) {
+		return false
+	}
+	ns := c.space(name, true)
+	c.clock++
+	if ele, ok := ns.items[key]; ok {
 		item := ele.Value.(*cacheItem)
+		c.bytes += size - item.entry.size
+		ns.bytes += size - item.entry.size
+		c.evicted(ns, key, item.entry.value, EvictReplaced)
 		item.entry.value = value
+		item.entry.contentType = contentType
+		item.entry.size = size
 		item.entry.expires = time.Now().Add(ttl)
-		c.ll.MoveToFront(ele)
-		return
+		item.entry.used = c.clock
+		ns.ll.MoveToFront(ele)
+		ns.updateMetrics()
+		c.emit(EventSet, ns.name, key, value)
+		c.enforceQuota(ns)
+		c.sizeMetric.Set(float64(c.size))
+		return true
 	}
-	ent := &entry{key: key, value: value, expires: time.Now().Add(ttl)}
+	ent := &entry{ns: ns, key: key, value: value, contentType: contentType, expires: time.Now().Add(ttl), size: size, used: c.clock}
 	item := &cacheItem{entry: ent}
-	ele := c.ll.PushFront(item)
-	c.items[key] = ele
-	if c.ll.Len() > c.capacity {
-		c.removeOldest()
+	ele := ns.ll.PushFront(item)
+	ns.items[key] = ele
+	ns.bytes += size
+	c.size++
+	c.bytes += size
+	ns.updateMetrics()
+	c.emit(EventSet, ns.name, key, value)
+	c.enforceQuota(ns)
+	for c.size > c.capacity {
+		c.evict(c.victim(ns), EvictCapacity)
 	}
-	c.sizeMetric.Set(float64(c.ll.Len()))
+	c.sizeMetric.Set(float64(c.size))
+	return true
 }
 
 func (c *Cache) Get(key string) ([]byte, bool) {
+	it, ok := c.get(DefaultNamespace, key)
+	return it.Value, ok
+}
+
+func (c *Cache) get(name, key string) (Item, bool) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
-	if ele, ok := c.items[key]; ok {
+	defer c.unlockAndNotify()
+	ns := c.space(name, false)
+	if ns == nil {
+		c.misses++
+		c.missesMetric.Inc()
+		return Item{}, false
+	}
+	if ele, ok := ns.items[key]; ok {
 		item := ele.Value.(*cacheItem)
 		if time.Now().After(item.entry.expires) {
-			c.ll.Remove(ele)
-			delete(c.items, key)
-			c.misses++
-			c.ttlExpired++
-			c.missesMetric.Inc()
-			c.ttlExpiredMetric.Inc()
-			c.sizeMetric.Set(float64(c.ll.Len()))
-			return nil, false
+			c.expire(ele)
+			c.miss(ns)
+			return Item{}, false
 		}
-		c.ll.MoveToFront(ele)
+		c.clock++
+		item.entry.used = c.clock
+		ns.ll.MoveToFront(ele)
 		c.hits++
 		c.hitsMetric.Inc()
-		return item.entry.value, true
+		ns.hits++
+		ns.hitsMetric.Inc()
+		return item.entry.item(), true
 	}
+	c.miss(ns)
+	return Item{}, false
+}
+
+func (e *entry) item() Item {
+	return Item{Key: e.key, Value: e.value, ContentType: e.contentType, Expires: e.expires}
+}
+
+func (c *Cache) miss(ns *namespace) {
 	c.misses++
 	c.missesMetric.Inc()
-	return nil, false
+	ns.misses++
+	ns.missesMetric.Inc()
 }
 
 func (c *Cache) Delete(key string) {
+	c.delete(DefaultNamespace, key, nil)
+}
+
+// delete removes key from namespace name, only if it matches one of the
+// tags when ifMatch is not nil. It reports whether an entry was removed.
+func (c *Cache) delete(name, key string, ifMatch []string) bool {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	ele := c.lookup(name, key)
+	if ele == nil || ifMatch != nil && !c.matches(ele, ifMatch) {
+		return false
+	}
+	c.removeElement(ele, EventDelete, EvictDeleted)
+	return true
+}
+
+// Exists reports whether key holds a live entry without counting a hit or
+// miss or touching its LRU position.
+func (c *Cache) Exists(key string) bool {
+	return c.exists(DefaultNamespace, key)
+}
+
+func (c *Cache) exists(name, key string) bool {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	ele := c.lookup(name, key)
+	if ele == nil {
+		return false
+	}
+	if time.Now().After(ele.Value.(*cacheItem).entry.expires) {
+		c.expire(ele)
+		return false
+	}
+	return true
+}
+
+// TTL returns the remaining lifetime of key.
+func (c *Cache) TTL(key string) (time.Duration, bool) {
+	return c.ttl(DefaultNamespace, key)
+}
+
+func (c *Cache) ttl(name, key string) (time.Duration, bool) {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	ele := c.lookup(name, key)
+	if ele == nil {
+		return 0, false
+	}
+	remaining := time.Until(ele.Value.(*cacheItem).entry.expires)
+	if remaining < 0 {
+		c.expire(ele)
+		return 0, false
+	}
+	return remaining, true
+}
+
+// Touch resets the TTL of a live entry and marks it as recently used.
+func (c *Cache) Touch(key string, ttl time.Duration) bool {
+	return c.touch(DefaultNamespace, key, ttl)
+}
+
+func (c *Cache) touch(name, key string, ttl time.Duration) bool {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	ele := c.lookup(name, key)
+	if ele == nil {
+		return false
+	}
+	item := ele.Value.(*cacheItem)
+	if time.Now().After(item.entry.expires) {
+		c.expire(ele)
+		return false
+	}
+	c.clock++
+	item.entry.expires = time.Now().Add(ttl)
+	item.entry.used = c.clock
+	item.entry.ns.ll.MoveToFront(ele)
+	return true
+}
+
+// Flush removes every entry, in every namespace, and returns how many were
+// dropped.
+func (c *Cache) Flush() int {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	n := 0
+	for _, ns := range c.spaces {
+		n += c.flush(ns)
+	}
+	return n
+}
+
+// flush empties ns. It must be called with the lock held.
+func (c *Cache) flush(ns *namespace) int {
+	n := ns.ll.Len()
+	for ele := ns.ll.Front(); ele != nil; ele = ele.Next() {
+		ent := ele.Value.(*cacheItem).entry
+		c.evicted(ns, ent.key, ent.value, EvictDeleted)
+		c.emit(EventDelete, ns.name, ent.key, ent.value)
+	}
+	ns.items = make(map[string]*list.Element)
+	ns.ll.Init()
+	c.size -= n
+	c.bytes -= ns.bytes
+	ns.bytes = 0
+	ns.updateMetrics()
+	c.dropIfIdle(ns)
+	c.sizeMetric.Set(float64(c.size))
+	return n
+}
+
+// Resize changes the capacity, evicting the least recently used entries
+// when it shrinks below the current size.
+func (c *Cache) Resize(capacity int) {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	c.capacity = capacity
+	for c.size > c.capacity {
+		c.evict(c.victim(nil), EvictCapacity)
+	}
+	c.sizeMetric.Set(float64(c.size))
+}
+
+// Stats sums every namespace; Namespace(name).Stats reports a single one.
+func (c *Cache) Stats() Stats {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	if ele, ok := c.items[key]; ok {
-		c.ll.Remove(ele)
-		delete(c.items, key)
-		c.sizeMetric.Set(float64(c.ll.Len()))
+	return Stats{
+		Hits:        int64(c.hits),
+		Misses:      int64(c.misses),
+		Size:        c.size,
+		Capacity:    c.capacity,
+		Evictions:   c.evictions,
+		Expirations: int64(c.ttlExpired),
+		Bytes:       c.bytes,
+		Uptime:      time.Since(c.created),
 	}
 }
 
-func (c *Cache) removeOldest() {
-	ele := c.ll.Back()
-	if ele != nil {
-		item := ele.Value.(*cacheItem)
-		delete(c.items, item.entry.key)
-		c.ll.Remove(ele)
-		c.sizeMetric.Set(float64(c.ll.Len()))
+// lookup returns the element for key in namespace name, or nil. It must be
+// called with the lock held.
+func (c *Cache) lookup(name, key string) *list.Element {
+	if ns := c.spaces[name]; ns != nil {
+		return ns.items[key]
+	}
+	return nil
+}
+
+func (c *Cache) expire(ele *list.Element) {
+	c.removeElement(ele, EventExpire, EvictExpired)
+	c.ttlExpired++
+	c.ttlExpiredMetric.Inc()
+}
+
+// evict drops ele to make room and counts it as an eviction.
+func (c *Cache) evict(ele *list.Element, reason EvictReason) {
+	ele.Value.(*cacheItem).entry.ns.evictions++
+	c.evictions++
+	c.removeElement(ele, EventEvict, reason)
+}
+
+// enforceQuota evicts the least recently used entries of ns until it is back
+// within its quota. An entry larger than the byte quota does not stay.
+func (c *Cache) enforceQuota(ns *namespace) {
+	for ns.overQuota() {
+		c.evict(ns.ll.Back(), EvictQuota)
+	}
+}
+
+// victim picks the entry to evict when the cache is over capacity: the least
+// recently used one among the namespaces without a quota, so a namespace
+// that stays within its quota is never pushed out by another. If every
+// namespace has a quota, writer makes room from its own keys; with no writer
+// the oldest entry overall goes.
+func (c *Cache) victim(writer *namespace) *list.Element {
+	var oldest, oldestQuoted *list.Element
+	for _, ns := range c.spaces {
+		back := ns.ll.Back()
+		if back == nil {
+			continue
+		}
+		if ns.quota == (Quota{}) {
+			oldest = older(oldest, back)
+		} else {
+			oldestQuoted = older(oldestQuoted, back)
+		}
 	}
+	switch {
+	case oldest != nil:
+		return oldest
+	case writer != nil && writer.ll.Len() > 0:
+		return writer.ll.Back()
+	default:
+		return oldestQuoted
+	}
+}
+
+func older(a, b *list.Element) *list.Element {
+	if a == nil || b.Value.(*cacheItem).entry.used < a.Value.(*cacheItem).entry.used {
+		return b
+	}
+	return a
+}
+
+func (c *Cache) removeElement(ele *list.Element, typ EventType, reason EvictReason) {
+	ent := ele.Value.(*cacheItem).entry
+	ns := ent.ns
+	delete(ns.items, ent.key)
+	ns.ll.Remove(ele)
+	ns.bytes -= ent.size
+	ns.updateMetrics()
+	c.size--
+	c.bytes -= ent.size
+	c.sizeMetric.Set(float64(c.size))
+	c.evicted(ns, ent.key, ent.value, reason)
+	c.emit(typ, ns.name, ent.key, ent.value)
+	c.dropIfIdle(ns)
 }
 
 func (c *Cache) Len() int {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	return c.ll.Len()
+	return c.size
 }
 
 func (c *Cache) Metrics() (hits, misses, size int) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	return int(c.hits), int(c.misses), c.ll.Len()
+	return int(c.hits), int(c.misses), c.size
 }
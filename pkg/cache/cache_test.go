@@ -1,6 +1,11 @@
 package cache
 
 import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -45,3 +50,298 @@ func TestCacheLRU(t *testing.T) {
 		t.Fatal("expected a to be evicted")
 	}
 }
+
+func TestCacheExistsTTLTouch(t *testing.T) {
+	c := newTestCache(10)
+	c.Set("foo", []byte("bar"), 50*time.Millisecond)
+	if !c.Exists("foo") || c.Exists("missing") {
+		t.Fatal("unexpected Exists result")
+	}
+	ttl, ok := c.TTL("foo")
+	if !ok || ttl <= 0 || ttl > 50*time.Millisecond {
+		t.Fatalf("unexpected TTL %v, %v", ttl, ok)
+	}
+	if !c.Touch("foo", time.Second) {
+		t.Fatal("expected Touch to find foo")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !c.Exists("foo") {
+		t.Fatal("expected Touch to extend the TTL")
+	}
+	if hits, misses, _ := c.Metrics(); hits != 0 || misses != 0 {
+		t.Fatalf("expected Exists/TTL/Touch not to count hits or misses, got %d/%d", hits, misses)
+	}
+}
+
+func TestCacheScan(t *testing.T) {
+	c := newTestCache(100)
+	for _, k := range []string{"user:3", "user:1", "session:1", "user:2", "user:4"} {
+		c.Set(k, []byte(k), time.Second)
+	}
+	c.Set("user:expired", []byte("x"), -time.Second)
+	var got []string
+	cursor := ""
+	for {
+		items, next := c.Scan("user:", cursor, 2)
+		for _, it := range items {
+			got = append(got, it.Key)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	want := []string{"user:1", "user:2", "user:3", "user:4"}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestScannerPagesThroughSnapshot(t *testing.T) {
+	c := newTestCache(100)
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("k%d", i), []byte("v"), time.Minute)
+	}
+	s := c.NewScanner("k", "k1")
+	c.Delete("k3")
+	c.Set("k55", []byte("v"), time.Minute)
+	var got []string
+	for {
+		page := s.Next(3)
+		if len(page) == 0 {
+			break
+		}
+		for _, it := range page {
+			got = append(got, it.Key)
+		}
+	}
+	want := []string{"k2", "k4", "k5", "k6", "k7", "k8", "k9"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected the keys present at the start and still live, %v, got %v", want, got)
+	}
+}
+
+func TestCacheFlushAndStats(t *testing.T) {
+	c := newTestCache(2)
+	c.Set("a", []byte("1"), time.Second)
+	c.Set("b", []byte("22"), time.Second)
+	c.Set("c", []byte("333"), time.Second)
+	c.Set("d", []byte("4"), -time.Second)
+	c.Get("d")
+	st := c.Stats()
+	if st.Evictions != 2 || st.Expirations != 1 || st.Size != 1 || st.Bytes != 4 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	if n := c.Flush(); n != 1 {
+		t.Fatalf("expected 1 entry flushed, got %d", n)
+	}
+	if st := c.Stats(); st.Size != 0 || st.Bytes != 0 {
+		t.Fatalf("expected empty cache after flush, got %+v", st)
+	}
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	c := newTestCache(1)
+	var events []Event
+	unsubscribe := c.Subscribe(func(ev Event) {
+		// Callbacks run outside the lock, so calling back in must not deadlock.
+		c.Len()
+		events = append(events, ev)
+	})
+	c.Set("a", []byte("1"), time.Second)
+	c.Set("b", []byte("2"), -time.Second)
+	c.Get("b")
+	c.Set("c", []byte("3"), time.Second)
+	c.Delete("c")
+	unsubscribe()
+	c.Set("d", []byte("4"), time.Second)
+
+	want := []struct {
+		typ EventType
+		key string
+	}{
+		{EventSet, "a"}, {EventSet, "b"}, {EventEvict, "a"}, {EventExpire, "b"},
+		{EventSet, "c"}, {EventDelete, "c"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), events)
+	}
+	for i, w := range want {
+		if events[i].Type != w.typ || events[i].Key != w.key {
+			t.Fatalf("event %d: expected %s %s, got %s %s", i, w.typ, w.key, events[i].Type, events[i].Key)
+		}
+	}
+}
+
+func TestCacheEventsInCommitOrder(t *testing.T) {
+	c := newTestCache(100)
+	var inFlight atomic.Int32
+	last := make(map[string]int)
+	c.Subscribe(func(ev Event) {
+		if inFlight.Add(1) != 1 {
+			t.Error("callbacks ran concurrently")
+		}
+		defer inFlight.Add(-1)
+		if ev.Type != EventSet {
+			return
+		}
+		n, _ := strconv.Atoi(string(ev.Value))
+		switch {
+		case ev.Key == "echo":
+			last["echo"]++
+		case ev.Key == "shared":
+			last["shared"] = n
+		case n != last[ev.Key]+1:
+			t.Errorf("%s: got %d after %d", ev.Key, n, last[ev.Key])
+		default:
+			last[ev.Key] = n
+			if n%100 == 0 {
+				// Changes made from a callback are queued behind this one.
+				c.Set("echo", ev.Value, time.Minute)
+			}
+		}
+	})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 1; n <= 500; n++ {
+				c.Set("shared", []byte(strconv.Itoa(w*1000+n)), time.Minute)
+				c.Set(fmt.Sprintf("w%d", w), []byte(strconv.Itoa(n)), time.Minute)
+			}
+		}()
+	}
+	wg.Wait()
+	for w := 0; w < 8; w++ {
+		if key := fmt.Sprintf("w%d", w); last[key] != 500 {
+			t.Fatalf("expected the last event of %s to be 500, got %d", key, last[key])
+		}
+	}
+	if last["echo"] != 8*5 {
+		t.Fatalf("expected 40 echo events, got %d", last["echo"])
+	}
+	// "shared" is written by every writer: the last event delivered must be
+	// the value that won.
+	v, _ := c.Get("shared")
+	if n, _ := strconv.Atoi(string(v)); last["shared"] != n {
+		t.Fatalf("expected the last shared event to carry %d, got %d", n, last["shared"])
+	}
+}
+
+func TestCacheOnEvict(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewWithRegistry(2, reg)
+	got := make(map[string]EvictReason)
+	var values []string
+	c.OnEvict(func(key string, value []byte, reason EvictReason) {
+		if _, ok := c.Get("probe"); ok {
+			t.Error("unexpected probe hit")
+		}
+		got[key+"="+string(value)] = reason
+		values = append(values, string(value))
+	})
+	c.Set("a", []byte("1"), time.Second)
+	c.Set("a", []byte("2"), time.Second)
+	c.Set("b", []byte("x"), -time.Second)
+	c.Get("b")
+	c.Set("c", []byte("3"), time.Second)
+	c.Set("d", []byte("4"), time.Second)
+	c.Delete("d")
+
+	want := map[string]EvictReason{
+		"a=1": EvictReplaced,
+		"b=x": EvictExpired,
+		"a=2": EvictCapacity,
+		"d=4": EvictDeleted,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for k, reason := range want {
+		if got[k] != reason {
+			t.Fatalf("expected %s evicted as %s, got %s", k, reason, got[k])
+		}
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "cache_evictions_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	for _, reason := range []string{"capacity", "expired", "deleted", "replaced"} {
+		if counts[reason] != 1 {
+			t.Fatalf("expected one %s eviction in metrics, got %v", reason, counts)
+		}
+	}
+}
+
+func TestCacheMetricOptions(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sessions := NewWithOptions(10, WithRegistry(reg), WithNamespace("shardo"),
+		WithConstLabels(prometheus.Labels{"cache": "sessions"}))
+	users := NewWithOptions(10, WithRegistry(reg), WithNamespace("shardo"),
+		WithConstLabels(prometheus.Labels{"cache": "users"}))
+	sessions.Set("a", []byte("1"), time.Second)
+	sessions.Get("a")
+	users.Get("missing")
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "shardo_cache_hits_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			hits[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	if hits["sessions"] != 1 || hits["users"] != 0 || len(hits) != 2 {
+		t.Fatalf("expected per-cache hit counters, got %v", hits)
+	}
+
+	quiet := NewWithOptions(10, WithoutMetrics())
+	quiet.Set("a", []byte("1"), time.Second)
+	if _, ok := quiet.Get("a"); !ok {
+		t.Fatal("expected cache without metrics to work")
+	}
+}
+
+func TestCacheResize(t *testing.T) {
+	c := newTestCache(3)
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Minute)
+	c.Set("c", []byte("3"), time.Minute)
+	c.Get("a")
+	c.Resize(1)
+	if c.Len() != 1 {
+		t.Fatalf("expected 1 entry after shrinking, got %d", c.Len())
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected most recently used entry to survive")
+	}
+	if s := c.Stats(); s.Evictions != 2 || s.Capacity != 1 {
+		t.Fatalf("expected 2 evictions and capacity 1, got %+v", s)
+	}
+	c.Resize(2)
+	c.Set("d", []byte("4"), time.Minute)
+	if c.Len() != 2 {
+		t.Fatalf("expected growth to keep both entries, got %d", c.Len())
+	}
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec converts values to and from the bytes stored in a Cache.
+type Codec[V any] interface {
+	Marshal(v V) ([]byte, error)
+	Unmarshal(data []byte) (V, error)
+}
+
+type JSONCodec[V any] struct{}
+
+func (JSONCodec[V]) Marshal(v V) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[V]) Unmarshal(data []byte) (V, error) {
+	var v V
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+type GobCodec[V any] struct{}
+
+func (GobCodec[V]) Marshal(v V) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[V]) Unmarshal(data []byte) (V, error) {
+	var v V
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// ProtoCodec stores generated protobuf messages; V is the message pointer
+// type, e.g. ProtoCodec[*cachepb.GetResponse].
+type ProtoCodec[V proto.Message] struct{}
+
+func (ProtoCodec[V]) Marshal(v V) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+func (ProtoCodec[V]) Unmarshal(data []byte) (V, error) {
+	var zero V
+	v := zero.ProtoReflect().Type().New().Interface().(V)
+	err := proto.Unmarshal(data, v)
+	return v, err
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"time"
+)
+
+// ETag returns the entity tag of value stored with contentType: a hex
+// digest of both. Replicas holding the same entry agree on it, so it is
+// stable across nodes, unlike a per-node version counter would be.
+func ETag(value []byte, contentType string) string {
+	h := sha256.New()
+	h.Write([]byte(contentType))
+	h.Write([]byte{0})
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// matches reports whether ele is a live entry whose ETag is one of etags,
+// or any live entry when etags holds "*". Expired entries are dropped.
+func (c *Cache) matches(ele *list.Element, etags []string) bool {
+	if ele == nil {
+		return false
+	}
+	ent := ele.Value.(*cacheItem).entry
+	if time.Now().After(ent.expires) {
+		c.expire(ele)
+		return false
+	}
+	return slices.Contains(etags, "*") || slices.Contains(etags, ETag(ent.value, ent.contentType))
+}
+
+// nonNil keeps a nil tag list from reading as "no condition".
+func nonNil(etags []string) []string {
+	if etags == nil {
+		return []string{}
+	}
+	return etags
+}
@@ -0,0 +1,175 @@
+package cache
+
+type EventType int
+
+const (
+	EventSet EventType = iota + 1
+	EventDelete
+	EventExpire
+	EventEvict
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDelete:
+		return "delete"
+	case EventExpire:
+		return "expire"
+	case EventEvict:
+		return "evict"
+	default:
+		return "unknown"
+	}
+}
+
+type EvictReason int
+
+const (
+	EvictCapacity EvictReason = iota + 1
+	EvictExpired
+	EvictDeleted
+	EvictReplaced
+	EvictQuota
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictCapacity:
+		return "capacity"
+	case EvictExpired:
+		return "expired"
+	case EvictDeleted:
+		return "deleted"
+	case EvictReplaced:
+		return "replaced"
+	case EvictQuota:
+		return "quota"
+	default:
+		return "unknown"
+	}
+}
+
+type eviction struct {
+	key    string
+	value  []byte
+	reason EvictReason
+}
+
+type Event struct {
+	Type      EventType
+	Namespace string
+	Key       string
+	Value     []byte
+}
+
+type subscriber struct {
+	id int
+	fn func(Event)
+}
+
+// Subscribe registers fn to be called for every change to the cache, in any
+// namespace, and returns a func that removes it. Callbacks run after the
+// cache lock is released, one at a time and in the order the changes were
+// made: on the goroutine that made the change, or on one already delivering
+// earlier changes. They may call back into the cache but should return
+// quickly. Expiry is detected lazily, when an expired entry is next accessed.
+func (c *Cache) Subscribe(fn func(Event)) func() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nextSubID++
+	id := c.nextSubID
+	c.subscribers = append(c.subscribers, subscriber{id: id, fn: fn})
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for i, s := range c.subscribers {
+			if s.id == id {
+				c.subscribers = append(c.subscribers[:i:i], c.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// OnEvict registers fn to be called whenever an entry leaves the cache or
+// its value is overwritten. Like Subscribe callbacks, fn runs after the
+// cache lock is released, in order with them.
+func (c *Cache) OnEvict(fn func(key string, value []byte, reason EvictReason)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.evictHandlers = append(c.evictHandlers, fn)
+}
+
+// evicted counts an entry dropped for reason and queues the OnEvict
+// callbacks. It must be called with the lock held.
+func (c *Cache) evicted(ns *namespace, key string, value []byte, reason EvictReason) {
+	c.evictionsMetric.WithLabelValues(reason.String()).Inc()
+	c.nsEvictionsMetric.WithLabelValues(ns.name, reason.String()).Inc()
+	if len(c.evictHandlers) == 0 {
+		return
+	}
+	c.pendingEvictions = append(c.pendingEvictions, eviction{key: key, value: value, reason: reason})
+}
+
+// emit queues an event for delivery once the lock is released. It must be
+// called with the lock held.
+func (c *Cache) emit(typ EventType, namespace, key string, value []byte) {
+	if len(c.subscribers) == 0 {
+		return
+	}
+	c.pending = append(c.pending, Event{Type: typ, Namespace: namespace, Key: key, Value: value})
+}
+
+// notification is what one locked section queued for delivery, with the
+// callbacks registered at the time.
+type notification struct {
+	events    []Event
+	subs      []subscriber
+	evictions []eviction
+	handlers  []func(key string, value []byte, reason EvictReason)
+}
+
+func (n notification) deliver() {
+	for _, ev := range n.evictions {
+		for _, fn := range n.handlers {
+			fn(ev.key, ev.value, ev.reason)
+		}
+	}
+	for _, ev := range n.events {
+		for _, s := range n.subs {
+			s.fn(ev)
+		}
+	}
+}
+
+// unlockAndNotify releases the lock and delivers the events queued while it
+// was held. They join the queue in commit order; if another goroutine is
+// already draining it, that one delivers them after the earlier ones, so
+// callbacks never see changes out of order or run concurrently. Changes
+// made from a callback are queued the same way rather than delivered
+// recursively.
+func (c *Cache) unlockAndNotify() {
+	if len(c.pending) > 0 || len(c.pendingEvictions) > 0 {
+		c.queue = append(c.queue, notification{
+			events: c.pending, subs: c.subscribers,
+			evictions: c.pendingEvictions, handlers: c.evictHandlers,
+		})
+		c.pending, c.pendingEvictions = nil, nil
+	}
+	if c.delivering {
+		c.lock.Unlock()
+		return
+	}
+	c.delivering = true
+	for len(c.queue) > 0 {
+		n := c.queue[0]
+		c.queue = c.queue[1:]
+		c.lock.Unlock()
+		n.deliver()
+		c.lock.Lock()
+	}
+	c.delivering = false
+	c.lock.Unlock()
+}
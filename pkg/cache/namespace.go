@@ -0,0 +1,240 @@
+package cache
+
+import (
+	"container/list"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultNamespace holds the keys written through the Cache methods and by
+// clients that do not name a namespace.
+const DefaultNamespace = "default"
+
+// ValidNamespace reports whether name is fit to travel in requests and
+// metric labels: 1 to 64 letters, digits, '-', '_' or '.'.
+func ValidNamespace(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Quota caps what a namespace may hold. A zero field means no limit.
+type Quota struct {
+	MaxKeys  int
+	MaxBytes int64
+}
+
+type NamespaceStats struct {
+	Hits      int64
+	Misses    int64
+	Size      int
+	Bytes     int64
+	Evictions int64
+	Quota     Quota
+}
+
+type namespace struct {
+	name  string
+	items map[string]*list.Element
+	ll    *list.List
+	bytes int64
+	quota Quota
+
+	hits      int64
+	misses    int64
+	evictions int64
+
+	entriesMetric prometheus.Gauge
+	bytesMetric   prometheus.Gauge
+	hitsMetric    prometheus.Counter
+	missesMetric  prometheus.Counter
+}
+
+func (ns *namespace) overQuota() bool {
+	return (ns.quota.MaxKeys > 0 && ns.ll.Len() > ns.quota.MaxKeys) ||
+		(ns.quota.MaxBytes > 0 && ns.bytes > ns.quota.MaxBytes)
+}
+
+func (ns *namespace) updateMetrics() {
+	ns.entriesMetric.Set(float64(ns.ll.Len()))
+	ns.bytesMetric.Set(float64(ns.bytes))
+}
+
+// space returns namespace name, creating it when create is set. It must be
+// called with the lock held.
+func (c *Cache) space(name string, create bool) *namespace {
+	if ns, ok := c.spaces[name]; ok || !create {
+		return ns
+	}
+	ns := &namespace{
+		name:          name,
+		items:         make(map[string]*list.Element),
+		ll:            list.New(),
+		entriesMetric: c.nsEntriesMetric.WithLabelValues(name),
+		bytesMetric:   c.nsBytesMetric.WithLabelValues(name),
+		hitsMetric:    c.nsHitsMetric.WithLabelValues(name),
+		missesMetric:  c.nsMissesMetric.WithLabelValues(name),
+	}
+	c.spaces[name] = ns
+	return ns
+}
+
+// dropIfIdle forgets ns and its metric series once it holds no keys and has
+// no quota, so namespaces named once by a client do not pile up. The default
+// namespace always stays. It must be called with the lock held.
+func (c *Cache) dropIfIdle(ns *namespace) {
+	if ns.ll.Len() > 0 || ns.quota != (Quota{}) || ns.name == DefaultNamespace || c.spaces[ns.name] != ns {
+		return
+	}
+	delete(c.spaces, ns.name)
+	c.nsEntriesMetric.DeleteLabelValues(ns.name)
+	c.nsBytesMetric.DeleteLabelValues(ns.name)
+	c.nsHitsMetric.DeleteLabelValues(ns.name)
+	c.nsMissesMetric.DeleteLabelValues(ns.name)
+	c.nsEvictionsMetric.DeletePartialMatch(prometheus.Labels{"namespace": ns.name})
+}
+
+// SetQuota caps namespace name, evicting its least recently used entries
+// right away if it holds more. A zero Quota lifts the cap.
+func (c *Cache) SetQuota(name string, q Quota) {
+	c.lock.Lock()
+	defer c.unlockAndNotify()
+	ns := c.space(namespaceName(name), true)
+	ns.quota = q
+	c.enforceQuota(ns)
+	c.dropIfIdle(ns)
+	c.sizeMetric.Set(float64(c.size))
+}
+
+// Namespaces returns the names of the namespaces that hold keys or have a
+// quota, plus DefaultNamespace, sorted. A namespace left empty without a
+// quota is dropped along with its metric series.
+func (c *Cache) Namespaces() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	names := make([]string, 0, len(c.spaces))
+	for name := range c.spaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Namespace returns a view of the keys in namespace name ("" is
+// DefaultNamespace). Keys in different namespaces never collide; the methods
+// behave like the Cache methods of the same name. Namespaces share the cache
+// capacity, but one with a quota is only ever evicted to stay within it.
+func (c *Cache) Namespace(name string) *Namespace {
+	return &Namespace{c: c, name: namespaceName(name)}
+}
+
+type Namespace struct {
+	c    *Cache
+	name string
+}
+
+func namespaceName(name string) string {
+	if name == "" {
+		return DefaultNamespace
+	}
+	return name
+}
+
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+func (n *Namespace) Set(key string, value []byte, ttl time.Duration) {
+	n.c.set(n.name, key, value, "", ttl, int64(len(key)+len(value)), nil)
+}
+
+// SetWithContentType is Set keeping the media type of value alongside it,
+// for GetItem to return.
+func (n *Namespace) SetWithContentType(key string, value []byte, contentType string, ttl time.Duration) {
+	n.c.set(n.name, key, value, contentType, ttl, int64(len(key)+len(value)+len(contentType)), nil)
+}
+
+// SetIfMatch is SetWithContentType for optimistic concurrency: the value is
+// only stored if key holds a live entry whose ETag is one of etags, or any
+// live entry when etags has "*". It reports whether the value was stored.
+func (n *Namespace) SetIfMatch(key string, value []byte, contentType string, ttl time.Duration, etags []string) bool {
+	return n.c.set(n.name, key, value, contentType, ttl, int64(len(key)+len(value)+len(contentType)), nonNil(etags))
+}
+
+func (n *Namespace) Get(key string) ([]byte, bool) {
+	it, ok := n.c.get(n.name, key)
+	return it.Value, ok
+}
+
+// GetItem is Get returning the content type and expiry with the value.
+func (n *Namespace) GetItem(key string) (Item, bool) {
+	return n.c.get(n.name, key)
+}
+
+func (n *Namespace) Delete(key string) {
+	n.c.delete(n.name, key, nil)
+}
+
+// DeleteIfMatch removes key under the same condition as SetIfMatch and
+// reports whether it did.
+func (n *Namespace) DeleteIfMatch(key string, etags []string) bool {
+	return n.c.delete(n.name, key, nonNil(etags))
+}
+
+func (n *Namespace) Exists(key string) bool {
+	return n.c.exists(n.name, key)
+}
+
+func (n *Namespace) TTL(key string) (time.Duration, bool) {
+	return n.c.ttl(n.name, key)
+}
+
+func (n *Namespace) Touch(key string, ttl time.Duration) bool {
+	return n.c.touch(n.name, key, ttl)
+}
+
+func (n *Namespace) Scan(prefix, cursor string, count int) ([]Item, string) {
+	return n.c.scan(n.name, prefix, cursor, count)
+}
+
+func (n *Namespace) NewScanner(prefix, cursor string) *Scanner {
+	return n.c.scanner(n.name, prefix, cursor)
+}
+
+// Flush removes every entry in the namespace, leaving the others alone.
+func (n *Namespace) Flush() int {
+	n.c.lock.Lock()
+	defer n.c.unlockAndNotify()
+	ns := n.c.space(n.name, false)
+	if ns == nil {
+		return 0
+	}
+	return n.c.flush(ns)
+}
+
+func (n *Namespace) Stats() NamespaceStats {
+	n.c.lock.Lock()
+	defer n.c.lock.Unlock()
+	ns := n.c.space(n.name, false)
+	if ns == nil {
+		return NamespaceStats{}
+	}
+	return NamespaceStats{
+		Hits:      ns.hits,
+		Misses:    ns.misses,
+		Size:      ns.ll.Len(),
+		Bytes:     ns.bytes,
+		Evictions: ns.evictions,
+		Quota:     ns.quota,
+	}
+}
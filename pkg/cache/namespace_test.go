@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNamespaceIsolationAndFlush(t *testing.T) {
+	c := newTestCache(10)
+	a, b := c.Namespace("team-a"), c.Namespace("team-b")
+	a.Set("k", []byte("a"), time.Minute)
+	b.Set("k", []byte("b"), time.Minute)
+	c.Set("k", []byte("default"), time.Minute)
+
+	if v, _ := a.Get("k"); string(v) != "a" {
+		t.Fatalf("expected team-a value, got %q", v)
+	}
+	if v, _ := c.Namespace("").Get("k"); string(v) != "default" {
+		t.Fatalf("expected the empty namespace to be the default one, got %q", v)
+	}
+	if items, _ := b.Scan("", "", 0); len(items) != 1 || string(items[0].Value) != "b" {
+		t.Fatalf("expected scan to stay inside team-b, got %+v", items)
+	}
+	if n := a.Flush(); n != 1 {
+		t.Fatalf("expected flush to drop 1 entry, got %d", n)
+	}
+	if a.Exists("k") || !b.Exists("k") || !c.Exists("k") {
+		t.Fatal("expected flush to leave other namespaces alone")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("expected 2 entries left, got %d", c.Len())
+	}
+}
+
+func TestNamespaceContentType(t *testing.T) {
+	c := newTestCache(10)
+	ns := c.Namespace("team-a")
+	ns.SetWithContentType("k", []byte("{}"), "application/json", time.Minute)
+	if it, ok := ns.GetItem("k"); !ok || it.ContentType != "application/json" || string(it.Value) != "{}" {
+		t.Fatalf("expected the value with its content type, got %+v", it)
+	}
+	if st := ns.Stats(); st.Bytes != int64(len("k{}application/json")) {
+		t.Fatalf("expected the content type to count in bytes, got %d", st.Bytes)
+	}
+	ns.Set("k", []byte("raw"), time.Minute)
+	if it, _ := ns.GetItem("k"); it.ContentType != "" {
+		t.Fatalf("expected Set to clear the content type, got %q", it.ContentType)
+	}
+}
+
+func TestNamespaceIfMatch(t *testing.T) {
+	c := newTestCache(10)
+	ns := c.Namespace("team-a")
+	if ns.SetIfMatch("k", []byte("v1"), "text/plain", time.Minute, []string{"*"}) {
+		t.Fatal("expected If-Match to fail on a missing key")
+	}
+	ns.SetWithContentType("k", []byte("v1"), "text/plain", time.Minute)
+	v1 := ETag([]byte("v1"), "text/plain")
+	if v1 == ETag([]byte("v1"), "application/json") {
+		t.Fatal("expected the content type to be part of the ETag")
+	}
+	if ns.SetIfMatch("k", []byte("v2"), "text/plain", time.Minute, []string{"stale"}) {
+		t.Fatal("expected a stale ETag to be refused")
+	}
+	if !ns.SetIfMatch("k", []byte("v2"), "text/plain", time.Minute, []string{"stale", v1}) {
+		t.Fatal("expected the current ETag to match")
+	}
+	if ns.SetIfMatch("k", []byte("v3"), "text/plain", time.Minute, nil) {
+		t.Fatal("expected nil tags to match nothing")
+	}
+	if ns.DeleteIfMatch("k", []string{v1}) {
+		t.Fatal("expected delete with the old ETag to be refused")
+	}
+	if !ns.DeleteIfMatch("k", []string{ETag([]byte("v2"), "text/plain")}) || ns.Exists("k") {
+		t.Fatal("expected delete with the current ETag to remove the key")
+	}
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	c := newTestCache(100)
+	var reasons []EvictReason
+	c.OnEvict(func(key string, value []byte, reason EvictReason) {
+		reasons = append(reasons, reason)
+	})
+	c.SetQuota("small", Quota{MaxKeys: 2})
+	ns := c.Namespace("small")
+	ns.Set("a", []byte("1"), time.Minute)
+	ns.Set("b", []byte("2"), time.Minute)
+	ns.Get("a")
+	ns.Set("c", []byte("3"), time.Minute)
+	if ns.Exists("b") || !ns.Exists("a") || !ns.Exists("c") {
+		t.Fatal("expected the least recently used key of the namespace to go")
+	}
+	if len(reasons) != 1 || reasons[0] != EvictQuota {
+		t.Fatalf("expected one quota eviction, got %v", reasons)
+	}
+
+	c.SetQuota("bytes", Quota{MaxBytes: 10})
+	big := c.Namespace("bytes")
+	big.Set("x", []byte("12345"), time.Minute)
+	big.Set("y", []byte("12345"), time.Minute)
+	if big.Exists("x") || !big.Exists("y") {
+		t.Fatal("expected the byte quota to evict x")
+	}
+	big.Set("z", []byte("way too large for the quota"), time.Minute)
+	if s := big.Stats(); s.Size != 0 || s.Bytes != 0 {
+		t.Fatalf("expected an entry over the byte quota not to stay, got %+v", s)
+	}
+}
+
+func TestNamespaceQuotaProtectsFromOtherTenants(t *testing.T) {
+	c := newTestCache(4)
+	c.SetQuota("paid", Quota{MaxKeys: 2})
+	paid, free := c.Namespace("paid"), c.Namespace("free")
+	paid.Set("a", []byte("1"), time.Minute)
+	paid.Set("b", []byte("2"), time.Minute)
+	for _, k := range []string{"1", "2", "3", "4", "5"} {
+		free.Set(k, []byte(k), time.Minute)
+	}
+	if !paid.Exists("a") || !paid.Exists("b") {
+		t.Fatal("expected a namespace within its quota to keep its keys")
+	}
+	if s := free.Stats(); s.Size != 2 || s.Evictions != 3 {
+		t.Fatalf("expected free to evict its own keys, got %+v", s)
+	}
+
+	// With only quota'd namespaces left, the writer makes room itself.
+	free.Flush()
+	c.SetQuota("other", Quota{MaxKeys: 3})
+	other := c.Namespace("other")
+	for _, k := range []string{"1", "2", "3"} {
+		other.Set(k, []byte(k), time.Minute)
+	}
+	if !paid.Exists("a") || !paid.Exists("b") || other.Exists("1") || c.Len() != 4 {
+		t.Fatalf("expected other to evict its own oldest key, got %d entries", c.Len())
+	}
+}
+
+func TestNamespaceMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewWithRegistry(10, reg)
+	c.SetQuota("t", Quota{MaxKeys: 1})
+	ns := c.Namespace("t")
+	ns.Set("a", []byte("1"), time.Minute)
+	ns.Set("b", []byte("2"), time.Minute)
+	ns.Get("b")
+	ns.Get("a")
+	c.Get("missing")
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			name := f.GetName()
+			for _, l := range m.GetLabel() {
+				name += "/" + l.GetValue()
+			}
+			got[name] = m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"cache_namespace_entries/t":               1,
+		"cache_namespace_hits_total/t":            1,
+		"cache_namespace_misses_total/t":          1,
+		"cache_namespace_misses_total/default":    1,
+		"cache_namespace_evictions_total/t/quota": 1,
+		"cache_namespace_bytes/t":                 2,
+	}
+	for name, v := range want {
+		if got[name] != v {
+			t.Fatalf("expected %s = %v, got %v", name, v, got)
+		}
+	}
+}
+
+func TestIdleNamespacesAreDropped(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewWithRegistry(10, reg)
+	c.Namespace("gone").Set("k", []byte("v"), time.Minute)
+	c.Namespace("flushed").Set("k", []byte("v"), time.Minute)
+	c.Namespace("expired").Set("k", []byte("v"), -time.Second)
+	c.Namespace("quoted").Set("k", []byte("v"), time.Minute)
+	c.SetQuota("quoted", Quota{MaxKeys: 5})
+	c.SetQuota("lifted", Quota{MaxKeys: 5})
+
+	c.Namespace("gone").Delete("k")
+	c.Namespace("flushed").Flush()
+	c.Namespace("expired").Get("k")
+	c.Namespace("quoted").Delete("k")
+	c.Namespace("never").Get("k")
+	c.SetQuota("lifted", Quota{})
+	c.Namespace("").Delete("missing")
+
+	if got := c.Namespaces(); !slices.Equal(got, []string{DefaultNamespace, "quoted"}) {
+		t.Fatalf("expected only default and the quoted namespace to stay, got %v", got)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "namespace" && l.GetValue() != DefaultNamespace && l.GetValue() != "quoted" {
+					t.Fatalf("expected the series of dropped namespaces to go, found %s{namespace=%q}", f.GetName(), l.GetValue())
+				}
+			}
+		}
+	}
+	// A dropped namespace comes back on the next write.
+	c.Namespace("gone").Set("k", []byte("v2"), time.Minute)
+	if v, _ := c.Namespace("gone").Get("k"); string(v) != "v2" {
+		t.Fatalf("expected the namespace to be recreated, got %q", v)
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Scanner pages through the keys of a namespace in key order. The matching
+// keys are collected once, when the scanner is created; each page then only
+// holds the cache lock while it copies its own entries out. Keys written
+// after that are not visited, and keys removed or expired since are skipped.
+type Scanner struct {
+	c    *Cache
+	name string
+	keys []string // sorted, not visited yet
+}
+
+// Scan returns up to count live entries whose keys start with prefix and sort
+// after cursor, in key order, together with the cursor for the next page
+// ("" once the scan is complete). A count <= 0 returns every match. Each call
+// walks the whole namespace to find its page: use NewScanner to go through
+// many pages.
+func (c *Cache) Scan(prefix, cursor string, count int) ([]Item, string) {
+	return c.scan(DefaultNamespace, prefix, cursor, count)
+}
+
+// NewScanner starts a scan of the keys that start with prefix and sort after
+// cursor.
+func (c *Cache) NewScanner(prefix, cursor string) *Scanner {
+	return c.scanner(DefaultNamespace, prefix, cursor)
+}
+
+func (c *Cache) scan(name, prefix, cursor string, count int) ([]Item, string) {
+	s := c.scanner(name, prefix, cursor)
+	items := s.Next(count)
+	if len(s.keys) == 0 || len(items) == 0 {
+		return items, ""
+	}
+	return items, items[len(items)-1].Key
+}
+
+func (c *Cache) scanner(name, prefix, cursor string) *Scanner {
+	s := &Scanner{c: c, name: name}
+	c.lock.Lock()
+	if ns := c.space(name, false); ns != nil {
+		for key := range ns.items {
+			if key > cursor && strings.HasPrefix(key, prefix) {
+				s.keys = append(s.keys, key)
+			}
+		}
+	}
+	c.lock.Unlock()
+	sort.Strings(s.keys)
+	return s
+}
+
+// Next returns up to count live entries following the previous page, or all
+// that are left when count <= 0. An empty page means the scan is complete.
+func (s *Scanner) Next(count int) []Item {
+	if len(s.keys) == 0 {
+		return nil
+	}
+	s.c.lock.Lock()
+	defer s.c.lock.Unlock()
+	ns := s.c.space(s.name, false)
+	if ns == nil {
+		s.keys = nil
+		return nil
+	}
+	now := time.Now()
+	var items []Item
+	for len(s.keys) > 0 && (count <= 0 || len(items) < count) {
+		ele, ok := ns.items[s.keys[0]]
+		s.keys = s.keys[1:]
+		if !ok {
+			continue
+		}
+		if e := ele.Value.(*cacheItem).entry; !now.After(e.expires) {
+			items = append(items, e.item())
+		}
+	}
+	return items
+}
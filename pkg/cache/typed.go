@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"fmt"
+	"time"
+)
+
+// TypedCache stores values of type V under keys of type K on top of a Cache,
+// so eviction, TTL, events and metrics behave exactly as for raw entries.
+type TypedCache[K comparable, V any] struct {
+	cache  *Cache
+	codec  Codec[V]
+	keyFn  func(K) string
+	sizeFn func(K, V) int64
+}
+
+// NewTyped wraps c. Keys are converted with fmt.Sprint unless WithKeyFunc
+// is used; string keys are stored as-is.
+func NewTyped[K comparable, V any](c *Cache, codec Codec[V]) *TypedCache[K, V] {
+	return &TypedCache[K, V]{
+		cache: c,
+		codec: codec,
+		keyFn: func(k K) string {
+			if s, ok := any(k).(string); ok {
+				return s
+			}
+			return fmt.Sprint(k)
+		},
+	}
+}
+
+func (t *TypedCache[K, V]) WithKeyFunc(fn func(K) string) *TypedCache[K, V] {
+	t.keyFn = fn
+	return t
+}
+
+// WithSizeEstimator replaces the encoded length with fn's estimate when
+// accounting bytes in Stats, e.g. to track the decoded in-memory size.
+func (t *TypedCache[K, V]) WithSizeEstimator(fn func(K, V) int64) *TypedCache[K, V] {
+	t.sizeFn = fn
+	return t
+}
+
+func (t *TypedCache[K, V]) Set(key K, value V, ttl time.Duration) error {
+	data, err := t.codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("cache: encoding value: %w", err)
+	}
+	k := t.keyFn(key)
+	size := int64(len(k) + len(data))
+	if t.sizeFn != nil {
+		size = t.sizeFn(key, value)
+	}
+	t.cache.set(DefaultNamespace, k, data, "", ttl, size, nil)
+	return nil
+}
+
+// Get returns the decoded value for key. A value that fails to decode is
+// reported as an error and left in place.
+func (t *TypedCache[K, V]) Get(key K) (V, bool, error) {
+	var zero V
+	data, ok := t.cache.Get(t.keyFn(key))
+	if !ok {
+		return zero, false, nil
+	}
+	v, err := t.codec.Unmarshal(data)
+	if err != nil {
+		return zero, false, fmt.Errorf("cache: decoding value: %w", err)
+	}
+	return v, true, nil
+}
+
+func (t *TypedCache[K, V]) Delete(key K) {
+	t.cache.Delete(t.keyFn(key))
+}
+
+func (t *TypedCache[K, V]) Exists(key K) bool {
+	return t.cache.Exists(t.keyFn(key))
+}
+
+func (t *TypedCache[K, V]) TTL(key K) (time.Duration, bool) {
+	return t.cache.TTL(t.keyFn(key))
+}
+
+func (t *TypedCache[K, V]) Touch(key K, ttl time.Duration) bool {
+	return t.cache.Touch(t.keyFn(key), ttl)
+}
+
+// Cache returns the underlying byte cache.
+func (t *TypedCache[K, V]) Cache() *Cache {
+	return t.cache
+}
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type testUser struct {
+	Name  string
+	Roles []string
+}
+
+func TestTypedCacheCodecs(t *testing.T) {
+	for name, codec := range map[string]Codec[testUser]{
+		"json": JSONCodec[testUser]{},
+		"gob":  GobCodec[testUser]{},
+	} {
+		users := NewTyped[int](newTestCache(10), codec)
+		want := testUser{Name: "ana", Roles: []string{"admin"}}
+		if err := users.Set(1, want, time.Second); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, ok, err := users.Get(1)
+		if err != nil || !ok || got.Name != want.Name || len(got.Roles) != 1 {
+			t.Fatalf("%s: expected %v, got %v %v %v", name, want, got, ok, err)
+		}
+		if _, ok, _ := users.Get(2); ok {
+			t.Fatalf("%s: expected miss", name)
+		}
+		if !users.Exists(1) {
+			t.Fatalf("%s: expected key to exist", name)
+		}
+		if _, ok := users.Cache().Get("1"); !ok {
+			t.Fatalf("%s: expected int key stored as \"1\"", name)
+		}
+	}
+
+	msgs := NewTyped[string](newTestCache(10), ProtoCodec[*wrapperspb.StringValue]{})
+	msgs.Set("greeting", wrapperspb.String("hello"), time.Second)
+	got, ok, err := msgs.Get("greeting")
+	if err != nil || !ok || got.GetValue() != "hello" {
+		t.Fatalf("expected hello, got %v %v %v", got, ok, err)
+	}
+}
+
+func TestTypedCacheSharesEvictionAndTTL(t *testing.T) {
+	c := newTestCache(2)
+	var reasons []EvictReason
+	c.OnEvict(func(key string, value []byte, reason EvictReason) {
+		reasons = append(reasons, reason)
+	})
+	nums := NewTyped[string](c, JSONCodec[int]{})
+	nums.Set("a", 1, time.Second)
+	nums.Set("b", 2, time.Second)
+	nums.Set("c", 3, time.Second)
+	if _, ok, _ := nums.Get("a"); ok {
+		t.Fatal("expected a to be evicted")
+	}
+	if len(reasons) != 1 || reasons[0] != EvictCapacity {
+		t.Fatalf("expected one capacity eviction, got %v", reasons)
+	}
+	nums.Set("short", 4, 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := nums.TTL("short"); ok {
+		t.Fatal("expected short to expire")
+	}
+}
+
+func TestTypedCacheSizeEstimator(t *testing.T) {
+	c := newTestCache(10)
+	users := NewTyped[string](c, JSONCodec[testUser]{}).
+		WithSizeEstimator(func(key string, u testUser) int64 { return 100 })
+	users.Set("a", testUser{Name: "ana"}, time.Second)
+	users.Set("b", testUser{Name: "bia"}, time.Second)
+	if b := c.Stats().Bytes; b != 200 {
+		t.Fatalf("expected 200 estimated bytes, got %d", b)
+	}
+	users.Delete("a")
+	if b := c.Stats().Bytes; b != 100 {
+		t.Fatalf("expected 100 bytes after delete, got %d", b)
+	}
+}
+
+func TestTypedCacheDecodeError(t *testing.T) {
+	c := newTestCache(10)
+	c.Set("bad", []byte("not json"), time.Second)
+	nums := NewTyped[string](c, JSONCodec[int]{})
+	if _, ok, err := nums.Get("bad"); err == nil || ok {
+		t.Fatalf("expected decode error, got %v %v", ok, err)
+	}
+}
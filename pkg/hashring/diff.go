@@ -0,0 +1,104 @@
+package hashring
+
+import (
+	"errors"
+	"slices"
+	"sort"
+)
+
+// RangeChange reports that keys hashing into (Start, End] moved from one node
+// to another. A range with Start >= End wraps around the end of the ring.
+type RangeChange struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+// Diff compares two rings over the union of their points and returns every
+// hash range whose owner differs, in ring order with adjacent ranges merged.
+// Both rings must use a registered hash function: custom ones cannot be told
+// apart, so their points would not be comparable.
+func Diff(old, new *HashRing) ([]RangeChange, error) {
+	// Copy one ring at a time so Diff never holds both locks.
+	before, after := old.copyPoints(), new.copyPoints()
+	if before.hashName == "" || after.hashName == "" {
+		return nil, errors.New("hashring: cannot diff rings using custom hash functions")
+	}
+	if before.hashName != after.hashName {
+		return nil, errors.New("hashring: cannot diff rings with different hash functions")
+	}
+	points := make([]uint64, 0, len(before.points)+len(after.points))
+	points = append(points, before.points...)
+	points = append(points, after.points...)
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+	points = dedupe(points)
+	if len(points) == 0 {
+		return nil, nil
+	}
+
+	var changes []RangeChange
+	prev := points[len(points)-1]
+	for _, p := range points {
+		from, to := before.ownerAt(p), after.ownerAt(p)
+		if from != to {
+			if n := len(changes); n > 0 && changes[n-1].End == prev && changes[n-1].From == from && changes[n-1].To == to {
+				changes[n-1].End = p
+			} else {
+				changes = append(changes, RangeChange{Start: prev, End: p, From: from, To: to})
+			}
+		}
+		prev = p
+	}
+	// The last range may continue into the first one across the wrap point.
+	if n := len(changes); n > 1 {
+		first, last := changes[0], changes[n-1]
+		if last.End == first.Start && last.From == first.From && last.To == first.To {
+			changes[0].Start = last.Start
+			changes = changes[:n-1]
+		}
+	}
+	return changes, nil
+}
+
+// ringPoints is a copy of a ring's points and their owners.
+type ringPoints struct {
+	hashName string
+	points   []uint64
+	owners   []string
+}
+
+func (h *HashRing) copyPoints() ringPoints {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	c := ringPoints{
+		hashName: hashFuncName(h.hashFn),
+		points:   slices.Clone(h.ring),
+		owners:   make([]string, len(h.ring)),
+	}
+	for i := range h.ring {
+		c.owners[i] = h.owner(i)
+	}
+	return c
+}
+
+func (c ringPoints) ownerAt(point uint64) string {
+	if len(c.points) == 0 {
+		return ""
+	}
+	idx, _ := slices.BinarySearch(c.points, point)
+	if idx == len(c.points) {
+		idx = 0
+	}
+	return c.owners[idx]
+}
+
+func dedupe(points []uint64) []uint64 {
+	out := points[:0]
+	for i, p := range points {
+		if i == 0 || p != points[i-1] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
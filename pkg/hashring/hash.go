@@ -0,0 +1,67 @@
+package hashring
+
+import (
+	"crypto/sha256"
+	"reflect"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/twmb/murmur3"
+)
+
+// HashFunc maps a key onto the 64-bit ring space.
+type HashFunc func(key string) uint64
+
+// SHA256 is the original ring hash: the first 4 bytes of the SHA-256 digest.
+// It only covers the low 32 bits of the ring and is kept as the default so
+// existing key placement does not change.
+func SHA256(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return uint64(sum[0])<<24 | uint64(sum[1])<<16 | uint64(sum[2])<<8 | uint64(sum[3])
+}
+
+func XXHash64(key string) uint64 {
+	return xxhash.Sum64String(key)
+}
+
+func Murmur3(key string) uint64 {
+	h1, _ := murmur3.StringSum128(key)
+	return h1
+}
+
+// FNV1a is the cheapest option but spreads near-identical keys less evenly;
+// prefer more virtual replicas when using it.
+func FNV1a(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	var h uint64 = offset64
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	return h
+}
+
+var hashFuncs = map[string]HashFunc{
+	"sha256":  SHA256,
+	"xxhash":  XXHash64,
+	"murmur3": Murmur3,
+	"fnv1a":   FNV1a,
+}
+
+func HashFuncByName(name string) (HashFunc, bool) {
+	fn, ok := hashFuncs[name]
+	return fn, ok
+}
+
+// hashFuncName returns the registered name of fn, or "" for custom functions.
+func hashFuncName(fn HashFunc) string {
+	ptr := reflect.ValueOf(fn).Pointer()
+	for name, known := range hashFuncs {
+		if reflect.ValueOf(known).Pointer() == ptr {
+			return name
+		}
+	}
+	return ""
+}
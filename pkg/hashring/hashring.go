@@ -1,7 +1,8 @@
 package hashring
 
 import (
-	"crypto/sha256"
+	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"sync"
@@ -10,33 +11,77 @@ import (
 type HashRing struct {
 	virtualReplicas int
 	nodes           map[string]struct{}
-	ring            []uint32
-	nodeMap         map[uint32]string
+	ring            []uint64
+	nodeMap         map[uint64][]string // point -> sorted claimants, the first owns it
+	hashFn          HashFunc
+	labels          map[string]Labels
+	weights         map[string]int
+	epoch           uint64
+	loads           map[string]int64
+	totalLoad       int64
+	epsilon         float64
 	lock            sync.RWMutex
 }
 
-func New(virtualReplicas int) *HashRing {
-	return &HashRing{
+type Labels struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+type Option func(*HashRing)
+
+// WithLoadBound enables consistent hashing with bounded loads: Acquire never
+// assigns a node more than ceil((1+epsilon) * average load). Zero disables it.
+func WithLoadBound(epsilon float64) Option {
+	return func(h *HashRing) {
+		h.epsilon = epsilon
+	}
+}
+
+func WithHashFunc(fn HashFunc) Option {
+	return func(h *HashRing) {
+		h.hashFn = fn
+	}
+}
+
+func New(virtualReplicas int, opts ...Option) *HashRing {
+	h := &HashRing{
 		virtualReplicas: virtualReplicas,
 		nodes:           make(map[string]struct{}),
-		nodeMap:         make(map[uint32]string),
+		nodeMap:         make(map[uint64][]string),
+		loads:           make(map[string]int64),
+		hashFn:          SHA256,
+		labels:          make(map[string]Labels),
+		weights:         make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt(h)
 	}
+	return h
 }
 
 func (h *HashRing) AddNode(node string) {
+	h.AddNodeWithLabels(node, Labels{})
+}
+
+func (h *HashRing) AddNodeWithLabels(node string, labels Labels) {
+	h.AddNodeWithWeight(node, 1, labels)
+}
+
+// AddNodeWithWeight adds node with weight times the configured number of
+// virtual nodes, so it receives a proportionally larger share of keys.
+func (h *HashRing) AddNodeWithWeight(node string, weight int, labels Labels) {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	if _, exists := h.nodes[node]; exists {
+	if _, exists := h.nodes[node]; exists || weight <= 0 {
 		return
 	}
 	h.nodes[node] = struct{}{}
-	for i := 0; i < h.virtualReplicas; i++ {
-		vNode := node + "#" + strconv.Itoa(i)
-		hash := hashKey(vNode)
-		h.ring = append(h.ring, hash)
-		h.nodeMap[hash] = node
-	}
-	sort.Slice(h.ring, func(i, j int) bool { return h.ring[i] < h.ring[j] })
+	h.labels[node] = labels
+	h.weights[node] = weight
+	h.placeVNodes(node)
+	h.epoch++
 }
 
 func (h *HashRing) RemoveNode(node string) {
@@ -45,15 +90,74 @@ func (h *HashRing) RemoveNode(node string) {
 	if _, exists := h.nodes[node]; !exists {
 		return
 	}
+	h.dropVNodes(node)
 	delete(h.nodes, node)
-	newRing := make([]uint32, 0, len(h.ring))
-	for i := 0; i < h.virtualReplicas; i++ {
-		vNode := node + "#" + strconv.Itoa(i)
-		hash := hashKey(vNode)
-		delete(h.nodeMap, hash)
+	delete(h.labels, node)
+	delete(h.weights, node)
+	h.totalLoad -= h.loads[node]
+	delete(h.loads, node)
+	h.epoch++
+}
+
+func (h *HashRing) SetWeight(node string, weight int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, exists := h.nodes[node]; !exists || weight <= 0 || h.weights[node] == weight {
+		return
+	}
+	h.dropVNodes(node)
+	h.weights[node] = weight
+	h.placeVNodes(node)
+	h.epoch++
+}
+
+func (h *HashRing) Weight(node string) int {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.weights[node]
+}
+
+// Epoch increases on every membership or weight change.
+func (h *HashRing) Epoch() uint64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.epoch
+}
+
+func (h *HashRing) placeVNodes(node string) {
+	for i := 0; i < h.virtualReplicas*h.weights[node]; i++ {
+		hash := h.hashFn(vNodeKey(node, i))
+		claimants := h.nodeMap[hash]
+		if len(claimants) == 0 {
+			h.ring = append(h.ring, hash)
+		}
+		idx := sort.SearchStrings(claimants, node)
+		claimants = append(claimants, "")
+		copy(claimants[idx+1:], claimants[idx:])
+		claimants[idx] = node
+		h.nodeMap[hash] = claimants
+	}
+	sort.Slice(h.ring, func(i, j int) bool { return h.ring[i] < h.ring[j] })
+}
+
+func (h *HashRing) dropVNodes(node string) {
+	for i := 0; i < h.virtualReplicas*h.weights[node]; i++ {
+		hash := h.hashFn(vNodeKey(node, i))
+		claimants := h.nodeMap[hash]
+		idx := sort.SearchStrings(claimants, node)
+		if idx == len(claimants) || claimants[idx] != node {
+			continue
+		}
+		claimants = append(claimants[:idx], claimants[idx+1:]...)
+		if len(claimants) == 0 {
+			delete(h.nodeMap, hash)
+		} else {
+			h.nodeMap[hash] = claimants
+		}
 	}
+	newRing := make([]uint64, 0, len(h.ring))
 	for _, hash := range h.ring {
-		if h.nodeMap[hash] != "" {
+		if len(h.nodeMap[hash]) > 0 {
 			newRing = append(newRing, hash)
 		}
 	}
@@ -66,12 +170,240 @@ func (h *HashRing) GetNode(key string) string {
 	if len(h.ring) == 0 {
 		return ""
 	}
-	hash := hashKey(key)
-	idx := sort.Search(len(h.ring), func(i int) bool { return h.ring[i] >= hash })
-	if idx == len(h.ring) {
-		idx = 0
+	return h.owner(h.search(h.hashFn(key)))
+}
+
+// GetNodes walks the ring clockwise from key and returns up to n distinct
+// physical nodes in preference order. The first entry is GetNode(key).
+func (h *HashRing) GetNodes(key string, n int) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.successors(key, n)
+}
+
+// GetReplicas picks up to n distinct nodes for key, spreading them across
+// zones first, then racks, then hosts, before falling back to plain ring
+// order. The first replica is always GetNode(key).
+func (h *HashRing) GetReplicas(key string, n int) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if n > len(h.nodes) {
+		n = len(h.nodes)
+	}
+	candidates := h.successors(key, len(h.nodes))
+	if len(candidates) == 0 || n <= 0 {
+		return nil
+	}
+	result := make([]string, 0, n)
+	picked := make(map[string]bool, n)
+	zones := make(map[string]bool)
+	racks := make(map[Labels]bool)
+	hosts := make(map[Labels]bool)
+	passes := []func(Labels) bool{
+		func(l Labels) bool { return !zones[l.Zone] },
+		func(l Labels) bool { return !racks[Labels{Zone: l.Zone, Rack: l.Rack}] },
+		func(l Labels) bool { return !hosts[l] },
+		func(Labels) bool { return true },
+	}
+	for _, accept := range passes {
+		for _, node := range candidates {
+			if len(result) == n {
+				return result
+			}
+			l := h.labels[node]
+			if picked[node] || !accept(l) {
+				continue
+			}
+			picked[node] = true
+			zones[l.Zone] = true
+			racks[Labels{Zone: l.Zone, Rack: l.Rack}] = true
+			hosts[l] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+func (h *HashRing) Labels(node string) Labels {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.labels[node]
+}
+
+func (h *HashRing) successors(key string, n int) []string {
+	if len(h.ring) == 0 || n <= 0 {
+		return nil
+	}
+	if n > len(h.nodes) {
+		n = len(h.nodes)
+	}
+	result := make([]string, 0, n)
+	seen := make(map[string]struct{}, n)
+	idx := h.search(h.hashFn(key))
+	for i := 0; i < len(h.ring) && len(result) < n; i++ {
+		for _, node := range h.nodeMap[h.ring[(idx+i)%len(h.ring)]] {
+			if _, ok := seen[node]; ok {
+				continue
+			}
+			seen[node] = struct{}{}
+			result = append(result, node)
+			if len(result) == n {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// Acquire returns the node that should serve key and counts one unit of load
+// against it. With a load bound configured, nodes already at capacity are
+// skipped in favour of the next successor on the ring, which does not hold
+// the key's data: use Acquire for stateless work and AcquireAmong to spread
+// reads over the replicas of stored keys. Every Acquire must be paired with a
+// Release of the returned node.
+func (h *HashRing) Acquire(key string) string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if len(h.ring) == 0 {
+		return ""
+	}
+	idx := h.search(h.hashFn(key))
+	node := h.owner(idx)
+	if h.epsilon > 0 {
+		limit := h.loadLimit()
+		for i := 0; i < len(h.ring); i++ {
+			candidate := h.owner((idx + i) % len(h.ring))
+			if float64(h.loads[candidate]+1) <= limit {
+				node = candidate
+				break
+			}
+		}
+	}
+	h.loads[node]++
+	h.totalLoad++
+	return node
+}
+
+// AcquireAmong picks which of nodes, the replicas of a key in preference
+// order, should serve a read and counts one unit of load against it. With a
+// load bound, the first node under the bound is picked, or nodes[0] when all
+// of them are at it. nodes is returned with the pick moved to the front, the
+// rest in their original order as fallbacks. Release the first node.
+func (h *HashRing) AcquireAmong(nodes []string) []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ordered := h.orderAmong(nodes)
+	if len(ordered) == 0 {
+		return ordered
+	}
+	if _, ok := h.nodes[ordered[0]]; ok {
+		h.loads[ordered[0]]++
+		h.totalLoad++
+	}
+	return ordered
+}
+
+// PickAmong orders nodes like AcquireAmong would right now, without counting
+// any load.
+func (h *HashRing) PickAmong(nodes []string) []string {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.orderAmong(nodes)
+}
+
+func (h *HashRing) orderAmong(nodes []string) []string {
+	if len(nodes) == 0 {
+		return nodes
+	}
+	pick := 0
+	if h.epsilon > 0 && len(h.nodes) > 0 {
+		limit := h.loadLimit()
+		for i, n := range nodes {
+			if _, ok := h.nodes[n]; ok && float64(h.loads[n]+1) <= limit {
+				pick = i
+				break
+			}
+		}
+	}
+	ordered := make([]string, 0, len(nodes))
+	ordered = append(ordered, nodes[pick])
+	ordered = append(ordered, nodes[:pick]...)
+	return append(ordered, nodes[pick+1:]...)
+}
+
+// AcquireNode counts one unit of load against node without routing, for
+// callers that pick nodes themselves (e.g. from GetReplicas).
+func (h *HashRing) AcquireNode(node string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.nodes[node]; !ok {
+		return
+	}
+	h.loads[node]++
+	h.totalLoad++
+}
+
+func (h *HashRing) Release(node string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.loads[node] <= 0 {
+		return
+	}
+	h.loads[node]--
+	h.totalLoad--
+}
+
+func (h *HashRing) Loads() map[string]int64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	result := make(map[string]int64, len(h.nodes))
+	for n := range h.nodes {
+		result[n] = h.loads[n]
+	}
+	return result
+}
+
+// LoadSkew reports the busiest node's load relative to the average load.
+// A perfectly balanced (or idle) ring reports 1.
+func (h *HashRing) LoadSkew() float64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.nodes) == 0 || h.totalLoad == 0 {
+		return 1
+	}
+	var maxLoad int64
+	for n := range h.nodes {
+		if h.loads[n] > maxLoad {
+			maxLoad = h.loads[n]
+		}
 	}
-	return h.nodeMap[h.ring[idx]]
+	avg := float64(h.totalLoad) / float64(len(h.nodes))
+	return float64(maxLoad) / avg
+}
+
+// Ownership reports the share of the hash space each node owns, i.e. the
+// fraction of keys it receives as primary. Shares sum to 1.
+func (h *HashRing) Ownership() map[string]float64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	result := make(map[string]float64, len(h.nodes))
+	for n := range h.nodes {
+		result[n] = 0
+	}
+	if len(h.ring) == 0 {
+		return result
+	}
+	// The legacy SHA256 hash only fills the low 32 bits of the ring.
+	space := math.Pow(2, 64)
+	if hashFuncName(h.hashFn) == "sha256" {
+		space = math.Pow(2, 32)
+	}
+	last := len(h.ring) - 1
+	result[h.owner(0)] += (float64(h.ring[0]) + space - float64(h.ring[last])) / space
+	for i := 1; i < len(h.ring); i++ {
+		result[h.owner(i)] += float64(h.ring[i]-h.ring[i-1]) / space
+	}
+	return result
 }
 
 func (h *HashRing) Nodes() []string {
@@ -84,9 +416,73 @@ func (h *HashRing) Nodes() []string {
 	return result
 }
 
-func hashKey(key string) uint32 {
-	h := sha256.New()
-	h.Write([]byte(key))
-	hash := h.Sum(nil)
-	return uint32(hash[0])<<24 | uint32(hash[1])<<16 | uint32(hash[2])<<8 | uint32(hash[3])
+// Validate checks the ring's internal invariants and reports the first
+// violation found. It is meant for tests and debugging.
+func (h *HashRing) Validate() error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if len(h.ring) != len(h.nodeMap) {
+		return fmt.Errorf("hashring: %d ring points but %d mapped points", len(h.ring), len(h.nodeMap))
+	}
+	claims := make(map[string]int, len(h.nodes))
+	for i, hash := range h.ring {
+		if i > 0 && h.ring[i-1] >= hash {
+			return fmt.Errorf("hashring: ring not strictly increasing at index %d", i)
+		}
+		claimants := h.nodeMap[hash]
+		if len(claimants) == 0 {
+			return fmt.Errorf("hashring: point %d has no owner", hash)
+		}
+		if !sort.StringsAreSorted(claimants) {
+			return fmt.Errorf("hashring: claimants of point %d are not sorted: %v", hash, claimants)
+		}
+		for _, n := range claimants {
+			if _, ok := h.nodes[n]; !ok {
+				return fmt.Errorf("hashring: point %d claimed by unknown node %s", hash, n)
+			}
+			claims[n]++
+		}
+	}
+	var total int64
+	for n := range h.nodes {
+		if want := h.virtualReplicas * h.weights[n]; claims[n] != want {
+			return fmt.Errorf("hashring: node %s has %d virtual nodes, want %d", n, claims[n], want)
+		}
+		total += h.loads[n]
+	}
+	for n := range h.loads {
+		if _, ok := h.nodes[n]; !ok {
+			return fmt.Errorf("hashring: load tracked for unknown node %s", n)
+		}
+	}
+	for n := range h.labels {
+		if _, ok := h.nodes[n]; !ok {
+			return fmt.Errorf("hashring: labels kept for unknown node %s", n)
+		}
+	}
+	if total != h.totalLoad {
+		return fmt.Errorf("hashring: total load %d does not match per-node sum %d", h.totalLoad, total)
+	}
+	return nil
+}
+
+func (h *HashRing) owner(idx int) string {
+	return h.nodeMap[h.ring[idx]][0]
+}
+
+func (h *HashRing) search(hash uint64) int {
+	idx := sort.Search(len(h.ring), func(i int) bool { return h.ring[i] >= hash })
+	if idx == len(h.ring) {
+		idx = 0
+	}
+	return idx
+}
+
+func (h *HashRing) loadLimit() float64 {
+	avg := float64(h.totalLoad+1) / float64(len(h.nodes))
+	return math.Ceil(avg * (1 + h.epsilon))
+}
+
+func vNodeKey(node string, i int) string {
+	return node + "#" + strconv.Itoa(i)
 }
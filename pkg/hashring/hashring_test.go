@@ -0,0 +1,322 @@
+package hashring
+
+import (
+	"crypto/sha256"
+	"math"
+	"math/rand"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+var benchHashFuncs = []string{"sha256", "xxhash", "murmur3", "fnv1a"}
+
+func TestHashRingGetNode(t *testing.T) {
+	h := New(50)
+	if n := h.GetNode("foo"); n != "" {
+		t.Fatalf("expected empty ring to return no node, got %s", n)
+	}
+	h.AddNode("a")
+	h.AddNode("b")
+	first := h.GetNode("foo")
+	if first == "" {
+		t.Fatal("expected a node for foo")
+	}
+	if again := h.GetNode("foo"); again != first {
+		t.Fatalf("expected stable mapping, got %s then %s", first, again)
+	}
+	h.RemoveNode(first)
+	if n := h.GetNode("foo"); n == first || n == "" {
+		t.Fatalf("expected foo to move off %s, got %q", first, n)
+	}
+}
+
+func TestHashRingGetNodes(t *testing.T) {
+	h := New(50)
+	if nodes := h.GetNodes("foo", 2); nodes != nil {
+		t.Fatalf("expected no nodes on empty ring, got %v", nodes)
+	}
+	for _, n := range []string{"a", "b", "c", "d"} {
+		h.AddNode(n)
+	}
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		nodes := h.GetNodes(key, 3)
+		if len(nodes) != 3 {
+			t.Fatalf("expected 3 nodes for %s, got %v", key, nodes)
+		}
+		if nodes[0] != h.GetNode(key) {
+			t.Fatalf("expected first node %s to be the owner %s", nodes[0], h.GetNode(key))
+		}
+		seen := make(map[string]bool)
+		for _, n := range nodes {
+			if seen[n] {
+				t.Fatalf("duplicate node %s in %v", n, nodes)
+			}
+			seen[n] = true
+		}
+	}
+	if nodes := h.GetNodes("foo", 10); len(nodes) != 4 {
+		t.Fatalf("expected n to be capped at 4 nodes, got %v", nodes)
+	}
+	before := h.GetNodes("foo", 2)
+	h.RemoveNode(before[0])
+	if after := h.GetNodes("foo", 1); after[0] != before[1] {
+		t.Fatalf("expected %s to take over foo, got %s", before[1], after[0])
+	}
+}
+
+func TestHashRingGetReplicasSpreadsZones(t *testing.T) {
+	h := New(50)
+	h.AddNodeWithLabels("a1", Labels{Zone: "a", Rack: "r1"})
+	h.AddNodeWithLabels("a2", Labels{Zone: "a", Rack: "r2"})
+	h.AddNodeWithLabels("a3", Labels{Zone: "a", Rack: "r2"})
+	h.AddNodeWithLabels("b1", Labels{Zone: "b", Rack: "r1"})
+	h.AddNodeWithLabels("c1", Labels{Zone: "c", Rack: "r1"})
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		replicas := h.GetReplicas(key, 3)
+		if len(replicas) != 3 {
+			t.Fatalf("expected 3 replicas, got %v", replicas)
+		}
+		if replicas[0] != h.GetNode(key) {
+			t.Fatalf("expected primary %s first, got %v", h.GetNode(key), replicas)
+		}
+		zones := make(map[string]bool)
+		for _, n := range replicas {
+			zones[h.Labels(n).Zone] = true
+		}
+		if len(zones) != 3 {
+			t.Fatalf("expected replicas in 3 zones, got %v", replicas)
+		}
+		replicas = h.GetReplicas(key, 4)
+		if len(replicas) != 4 {
+			t.Fatalf("expected 4 replicas, got %v", replicas)
+		}
+		racks := make(map[Labels]bool)
+		for _, n := range replicas {
+			l := h.Labels(n)
+			racks[Labels{Zone: l.Zone, Rack: l.Rack}] = true
+		}
+		if len(racks) != 4 {
+			t.Fatalf("expected the fourth replica on a new rack, got %v", replicas)
+		}
+	}
+	h.RemoveNode("b1")
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHashRingBoundedLoads(t *testing.T) {
+	const epsilon = 0.25
+	h := New(100, WithLoadBound(epsilon))
+	for i := 0; i < 4; i++ {
+		h.AddNode("node" + strconv.Itoa(i))
+	}
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		if h.Acquire("key"+strconv.Itoa(i)) == "" {
+			t.Fatal("expected a node")
+		}
+	}
+	limit := math.Ceil(float64(keys) / 4 * (1 + epsilon))
+	for n, load := range h.Loads() {
+		if float64(load) > limit {
+			t.Fatalf("node %s has load %d above bound %v", n, load, limit)
+		}
+	}
+	if skew := h.LoadSkew(); skew > 1+epsilon+0.01 {
+		t.Fatalf("expected skew <= %v, got %v", 1+epsilon, skew)
+	}
+}
+
+func TestHashRingHotKeySpillsToSuccessor(t *testing.T) {
+	h := New(100, WithLoadBound(0.1))
+	h.AddNode("a")
+	h.AddNode("b")
+	h.AddNode("c")
+	owner := h.GetNode("hot")
+	seen := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		seen[h.Acquire("hot")] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expected hot key to spill past %s, only saw %v", owner, seen)
+	}
+	for n := range seen {
+		for h.Loads()[n] > 0 {
+			h.Release(n)
+		}
+	}
+	if skew := h.LoadSkew(); skew != 1 {
+		t.Fatalf("expected idle ring skew 1, got %v", skew)
+	}
+	if n := h.Acquire("hot"); n != owner {
+		t.Fatalf("expected idle ring to route hot to owner %s, got %s", owner, n)
+	}
+}
+
+func TestAcquireAmongStaysOnReplicas(t *testing.T) {
+	h := New(100, WithLoadBound(0.1))
+	for _, n := range []string{"a", "b", "c", "d"} {
+		h.AddNode(n)
+	}
+	replicas := h.GetReplicas("hot", 2)
+	seen := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		want := h.PickAmong(replicas)
+		nodes := h.AcquireAmong(replicas)
+		if !slices.Equal(nodes, want) {
+			t.Fatalf("expected PickAmong to predict %v, got %v", nodes, want)
+		}
+		if len(nodes) != 2 || !slices.Contains(replicas, nodes[0]) || !slices.Contains(replicas, nodes[1]) {
+			t.Fatalf("expected a reordering of %v, got %v", replicas, nodes)
+		}
+		seen[nodes[0]]++
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expected the hot key to spread over both replicas, got %v", seen)
+	}
+	if loads := h.Loads(); loads[replicas[0]]+loads[replicas[1]] != 40 {
+		t.Fatalf("expected one unit of load per read on the replicas, got %v", loads)
+	}
+
+	idle := New(100)
+	idle.AddNode("a")
+	idle.AddNode("b")
+	if nodes := idle.AcquireAmong([]string{"b", "a"}); nodes[0] != "b" {
+		t.Fatalf("expected preference order without a bound, got %v", nodes)
+	}
+}
+
+func TestSHA256MatchesLegacyHash(t *testing.T) {
+	for _, key := range []string{"", "foo", "node1#0", "key42"} {
+		h := sha256.New()
+		h.Write([]byte(key))
+		sum := h.Sum(nil)
+		legacy := uint32(sum[0])<<24 | uint32(sum[1])<<16 | uint32(sum[2])<<8 | uint32(sum[3])
+		if got := SHA256(key); got != uint64(legacy) {
+			t.Fatalf("SHA256(%q) = %d, want %d", key, got, legacy)
+		}
+	}
+}
+
+func TestHashFuncsDistributeKeys(t *testing.T) {
+	for _, name := range benchHashFuncs {
+		fn, ok := HashFuncByName(name)
+		if !ok {
+			t.Fatalf("missing hash func %s", name)
+		}
+		h := New(100, WithHashFunc(fn))
+		h.AddNode("a")
+		h.AddNode("b")
+		h.AddNode("c")
+		dist := make(map[string]int)
+		for i := 0; i < 3000; i++ {
+			dist[h.GetNode("key"+strconv.Itoa(i))]++
+		}
+		for _, n := range []string{"a", "b", "c"} {
+			// FNV-1a spreads sequential names noticeably worse than the
+			// others, so only guard against a node being starved.
+			if dist[n] < 250 {
+				t.Fatalf("%s: node %s only got %d of 3000 keys", name, n, dist[n])
+			}
+		}
+	}
+}
+
+func BenchmarkGetNode(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+	for _, name := range benchHashFuncs {
+		fn, _ := HashFuncByName(name)
+		h := New(100, WithHashFunc(fn))
+		for i := 0; i < 10; i++ {
+			h.AddNode("node" + strconv.Itoa(i))
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				h.GetNode(keys[i%len(keys)])
+			}
+		})
+	}
+}
+
+func BenchmarkHashFunc(b *testing.B) {
+	for _, name := range benchHashFuncs {
+		fn, _ := HashFuncByName(name)
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				fn("tenant-42:session:9f86d081884c7d65")
+			}
+		})
+	}
+}
+
+// collidingHash squeezes the ring into 64 points so virtual nodes collide.
+func collidingHash(key string) uint64 {
+	return FNV1a(key) % 64
+}
+
+func TestHashRingCollisionsAreDeterministic(t *testing.T) {
+	a := New(20, WithHashFunc(collidingHash))
+	b := New(20, WithHashFunc(collidingHash))
+	for _, n := range []string{"n1", "n2", "n3"} {
+		a.AddNode(n)
+	}
+	for _, n := range []string{"n3", "n1", "n2"} {
+		b.AddNode(n)
+	}
+	for i := 0; i < 200; i++ {
+		key := "key" + strconv.Itoa(i)
+		if a.GetNode(key) != b.GetNode(key) {
+			t.Fatalf("insertion order changed owner of %s", key)
+		}
+	}
+	a.RemoveNode("n1")
+	if err := a.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		if n := a.GetNode("key" + strconv.Itoa(i)); n != "n2" && n != "n3" {
+			t.Fatalf("expected surviving owner, got %q", n)
+		}
+	}
+}
+
+func TestHashRingValidateAfterRandomChurn(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	h := New(30, WithHashFunc(collidingHash))
+	for step := 0; step < 500; step++ {
+		node := "node" + strconv.Itoa(rng.Intn(8))
+		if rng.Intn(2) == 0 {
+			h.AddNode(node)
+		} else {
+			h.RemoveNode(node)
+		}
+		if err := h.Validate(); err != nil {
+			t.Fatalf("step %d: %v", step, err)
+		}
+	}
+}
+
+func TestHashRingOwnership(t *testing.T) {
+	for _, name := range benchHashFuncs {
+		fn, _ := HashFuncByName(name)
+		h := New(100, WithHashFunc(fn))
+		h.AddNode("a")
+		h.AddNodeWithWeight("b", 3, Labels{})
+		share := h.Ownership()
+		if total := share["a"] + share["b"]; math.Abs(total-1) > 1e-9 {
+			t.Fatalf("%s: expected shares to sum to 1, got %v", name, total)
+		}
+		if share["b"] < 0.6 || share["b"] > 0.9 {
+			t.Fatalf("%s: expected b to own about 3/4 of the ring, got %v", name, share)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package hashring
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const snapshotVersion = 1
+
+var binaryMagic = []byte("SHRG")
+
+// Snapshot is the stable, serializable description of a ring. Two rings
+// built from the same snapshot place every key identically.
+type Snapshot struct {
+	Version         int            `json:"version"`
+	Epoch           uint64         `json:"epoch"`
+	HashFunc        string         `json:"hash_func"`
+	VirtualReplicas int            `json:"virtual_replicas"`
+	Nodes           []SnapshotNode `json:"nodes"`
+}
+
+type SnapshotNode struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+	Zone   string `json:"zone,omitempty"`
+	Rack   string `json:"rack,omitempty"`
+	Host   string `json:"host,omitempty"`
+}
+
+func (h *HashRing) Snapshot() Snapshot {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	s := Snapshot{
+		Version:         snapshotVersion,
+		Epoch:           h.epoch,
+		HashFunc:        hashFuncName(h.hashFn),
+		VirtualReplicas: h.virtualReplicas,
+		Nodes:           make([]SnapshotNode, 0, len(h.nodes)),
+	}
+	for n := range h.nodes {
+		l := h.labels[n]
+		s.Nodes = append(s.Nodes, SnapshotNode{Name: n, Weight: h.weights[n], Zone: l.Zone, Rack: l.Rack, Host: l.Host})
+	}
+	sort.Slice(s.Nodes, func(i, j int) bool { return s.Nodes[i].Name < s.Nodes[j].Name })
+	return s
+}
+
+// FromSnapshot rebuilds a ring. A snapshot of a ring using a custom hash
+// function carries no hash name, so the function must be passed back in
+// with WithHashFunc.
+func FromSnapshot(s Snapshot, opts ...Option) (*HashRing, error) {
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("hashring: unsupported snapshot version %d", s.Version)
+	}
+	if s.VirtualReplicas <= 0 {
+		return nil, fmt.Errorf("hashring: invalid virtual replica count %d", s.VirtualReplicas)
+	}
+	if s.HashFunc != "" {
+		fn, ok := HashFuncByName(s.HashFunc)
+		if !ok {
+			return nil, fmt.Errorf("hashring: unknown hash function %q", s.HashFunc)
+		}
+		opts = append([]Option{WithHashFunc(fn)}, opts...)
+	}
+	h := New(s.VirtualReplicas, opts...)
+	if s.HashFunc == "" && hashFuncName(h.hashFn) != "" {
+		return nil, errors.New("hashring: snapshot uses a custom hash function, pass it with WithHashFunc")
+	}
+	for _, n := range s.Nodes {
+		if n.Name == "" || n.Weight <= 0 {
+			return nil, fmt.Errorf("hashring: invalid node %q with weight %d", n.Name, n.Weight)
+		}
+		if _, exists := h.nodes[n.Name]; exists {
+			return nil, fmt.Errorf("hashring: duplicate node %q", n.Name)
+		}
+		h.AddNodeWithWeight(n.Name, n.Weight, Labels{Zone: n.Zone, Rack: n.Rack, Host: n.Host})
+	}
+	h.epoch = s.Epoch
+	return h, nil
+}
+
+func (h *HashRing) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.Snapshot())
+}
+
+// MarshalBinary encodes the ring snapshot as a compact, length-prefixed
+// byte stream starting with the "SHRG" magic.
+func (h *HashRing) MarshalBinary() ([]byte, error) {
+	s := h.Snapshot()
+	var buf bytes.Buffer
+	buf.Write(binaryMagic)
+	putUvarint(&buf, uint64(s.Version))
+	putUvarint(&buf, s.Epoch)
+	putString(&buf, s.HashFunc)
+	putUvarint(&buf, uint64(s.VirtualReplicas))
+	putUvarint(&buf, uint64(len(s.Nodes)))
+	for _, n := range s.Nodes {
+		putString(&buf, n.Name)
+		putUvarint(&buf, uint64(n.Weight))
+		putString(&buf, n.Zone)
+		putString(&buf, n.Rack)
+		putString(&buf, n.Host)
+	}
+	return buf.Bytes(), nil
+}
+
+// Load decodes a ring produced by MarshalJSON or MarshalBinary.
+func Load(data []byte, opts ...Option) (*HashRing, error) {
+	var s Snapshot
+	if bytes.HasPrefix(data, binaryMagic) {
+		var err error
+		if s, err = decodeBinary(bytes.NewReader(data[len(binaryMagic):])); err != nil {
+			return nil, fmt.Errorf("hashring: decoding binary snapshot: %w", err)
+		}
+	} else if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("hashring: decoding JSON snapshot: %w", err)
+	}
+	return FromSnapshot(s, opts...)
+}
+
+func decodeBinary(r *bytes.Reader) (Snapshot, error) {
+	var s Snapshot
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return s, err
+	}
+	s.Version = int(version)
+	if s.Epoch, err = binary.ReadUvarint(r); err != nil {
+		return s, err
+	}
+	if s.HashFunc, err = readString(r); err != nil {
+		return s, err
+	}
+	replicas, err := binary.ReadUvarint(r)
+	if err != nil {
+		return s, err
+	}
+	s.VirtualReplicas = int(replicas)
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return s, err
+	}
+	if count > uint64(r.Len()) {
+		return s, fmt.Errorf("node count %d exceeds remaining data", count)
+	}
+	s.Nodes = make([]SnapshotNode, count)
+	for i := range s.Nodes {
+		n := &s.Nodes[i]
+		if n.Name, err = readString(r); err != nil {
+			return s, err
+		}
+		weight, err := binary.ReadUvarint(r)
+		if err != nil {
+			return s, err
+		}
+		n.Weight = int(weight)
+		for _, field := range []*string{&n.Zone, &n.Rack, &n.Host} {
+			if *field, err = readString(r); err != nil {
+				return s, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(r.Len()) {
+		return "", fmt.Errorf("string length %d exceeds remaining data", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
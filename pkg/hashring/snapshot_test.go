@@ -0,0 +1,138 @@
+package hashring
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	h := New(40, WithHashFunc(XXHash64))
+	h.AddNodeWithWeight("a", 2, Labels{Zone: "z1", Rack: "r1"})
+	h.AddNode("b")
+	h.AddNodeWithLabels("c", Labels{Zone: "z2", Host: "h3"})
+	h.RemoveNode("b")
+
+	jsonData, err := h.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binData, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"json": jsonData, "binary": binData} {
+		loaded, err := Load(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := loaded.Validate(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if loaded.Epoch() != h.Epoch() {
+			t.Fatalf("%s: expected epoch %d, got %d", name, h.Epoch(), loaded.Epoch())
+		}
+		if loaded.Weight("a") != 2 || loaded.Labels("c").Host != "h3" {
+			t.Fatalf("%s: weights or labels not restored", name)
+		}
+		for i := 0; i < 500; i++ {
+			key := "key" + strconv.Itoa(i)
+			if loaded.GetNode(key) != h.GetNode(key) {
+				t.Fatalf("%s: %s placed differently after load", name, key)
+			}
+		}
+	}
+}
+
+func TestLoadRejectsCustomHashWithoutFunc(t *testing.T) {
+	h := New(10, WithHashFunc(collidingHash))
+	h.AddNode("a")
+	data, _ := h.MarshalJSON()
+	if _, err := Load(data); err == nil {
+		t.Fatal("expected error loading a custom-hash ring without its hash function")
+	}
+	if _, err := Load(data, WithHashFunc(collidingHash)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiffReportsMovedRanges(t *testing.T) {
+	old := New(50)
+	for _, n := range []string{"a", "b", "c"} {
+		old.AddNode(n)
+	}
+	data, _ := old.MarshalBinary()
+	grown, _ := Load(data)
+	grown.AddNode("d")
+
+	changes, err := Diff(old, grown)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) == 0 {
+		t.Fatal("expected ranges to move to d")
+	}
+	for _, c := range changes {
+		if c.To != "d" {
+			t.Fatalf("adding d should only move ranges to d, got %+v", c)
+		}
+	}
+	for i := 0; i < 2000; i++ {
+		key := "key" + strconv.Itoa(i)
+		moved := old.GetNode(key) != grown.GetNode(key)
+		hash := SHA256(key)
+		covered := false
+		for _, c := range changes {
+			if inRange(hash, c) {
+				covered = true
+				break
+			}
+		}
+		if moved != covered {
+			t.Fatalf("%s moved=%v but covered by diff=%v", key, moved, covered)
+		}
+	}
+	if changes, _ := Diff(old, old); len(changes) != 0 {
+		t.Fatalf("expected no changes diffing a ring with itself, got %d", len(changes))
+	}
+	custom := New(50, WithHashFunc(collidingHash))
+	if _, err := Diff(custom, New(50, WithHashFunc(FNV1a))); err == nil {
+		t.Fatal("expected rings with custom hash functions to be rejected")
+	}
+}
+
+func TestDiffWhileRingsChange(t *testing.T) {
+	a, b := New(20), New(20)
+	for _, n := range []string{"n1", "n2", "n3"} {
+		a.AddNode(n)
+		b.AddNode(n)
+	}
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*HashRing{{a, b}, {b, a}} {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if _, err := Diff(pair[0], pair[1]); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pair[0].AddNode("extra")
+				pair[0].RemoveNode("extra")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func inRange(hash uint64, c RangeChange) bool {
+	if c.Start < c.End {
+		return hash > c.Start && hash <= c.End
+	}
+	return hash > c.Start || hash <= c.End
+}